@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Checks if `dir` (named after torrent) already holds its data, e.g. downloaded elsewhere
+func hasTorrentData(dir string, info *metainfo.Info) (bool, error) {
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !stat.IsDir() {
+		if info.IsDir() {
+			return false, errors.New("file with torrent name exists, but torrent is a dir")
+		}
+		return true, nil
+	}
+	if _, err := os.Stat(dir + "/this.torrent"); err == nil {
+		return false, errors.New("dir already has another torrent")
+	}
+	for _, f := range info.UpvertedFiles() {
+		name, err := mmapFilePath(info, f, dir)
+		if err != nil {
+			return false, err
+		}
+		if _, err := os.Stat(name); err == nil {
+			return true, nil
+		}
+	}
+	return false, errors.New("dir exists, but has no files of torrent")
+}
+
+// Makes torrent dir from existing data and moves torrent file into it. Library verifies
+// pieces with unknown completion on add, only missing pieces are downloaded
+func adoptTorrentData(path, dir string, info *metainfo.Info) error {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		// Single file torrent, file goes into dir with the same name
+		tmp := dir + ".adopt"
+		if err = os.Rename(dir, tmp); err != nil {
+			return err
+		}
+		if err = os.Mkdir(dir, 0o750); err != nil {
+			os.Rename(tmp, dir)
+			return err
+		}
+		name, err := mmapFilePath(info, info.UpvertedFiles()[0], dir)
+		if err != nil {
+			return err
+		}
+		if err = os.Rename(tmp, name); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path, dir+"/this.torrent")
+}
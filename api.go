@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/types"
+)
+
+// Torrent files are small, anything bigger is a mistake
+const MaxTorrentFileSize = 10 << 20
+
+// HTTP API is served under `<WebDavPath>/api/v1/`
+const APIPath = "/api/v1"
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiAdded struct {
+	InfoHash string `json:"infohash"`
+	Path     string `json:"path"` // WebDav path of torrent dir
+}
+
+type apiTorrent struct {
+	InfoHash     string    `json:"infohash"`
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	State        string    `json:"state"`
+	Error        string    `json:"error,omitempty"`
+	Size         int64     `json:"size"`
+	Completed    int64     `json:"completed"`
+	Progress     float64   `json:"progress"` // From 0 to 1
+	Downloaded   int64     `json:"downloaded"`
+	Uploaded     int64     `json:"uploaded"`
+	DownloadRate int64     `json:"download_rate"` // Bytes per second
+	UploadRate   int64     `json:"upload_rate"`
+	Peers        apiPeers  `json:"peers"`
+	Limits       Limits    `json:"limits"`
+	Storage      string    `json:"storage"`
+	Files        []apiFile `json:"files,omitempty"`
+}
+
+type apiPeers struct {
+	Active  int `json:"active"`
+	Total   int `json:"total"`
+	Seeders int `json:"seeders"`
+}
+
+type apiFile struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Completed int64  `json:"completed"`
+	Priority  string `json:"priority"`
+}
+
+// Routes:
+//
+//	GET    /torrents                 list of torrents
+//	POST   /torrents                 add torrent
+//	GET    /events                   stream of events, see apiEvents
+//	GET    /torrents/HASH            torrent with files
+//	DELETE /torrents/HASH[?data=1]   drop torrent, optionally with its dir
+//	POST   /torrents/HASH/pause      same as `paused` file
+//	POST   /torrents/HASH/resume
+//	POST   /torrents/HASH/recheck    same as `recheck` file
+//	PUT    /torrents/HASH/files      {"path": "skip|normal|high"}, saved to `files.txt`
+//	GET    /torrents/HASH/limits     {"download": 0, "upload": 0} in bytes per second
+//	PUT    /torrents/HASH/limits     saved to `limits.txt` of torrent
+//	GET    /limits                   global limits
+//	PUT    /limits                   saved to `limits.txt` of torrents dir
+func serveAPI(w http.ResponseWriter, req *http.Request, prefix string) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, filepath.Join(prefix, APIPath)), "/")
+	route := strings.Split(path, "/")
+	method := req.Method
+	user := requestUser(req)
+	if method != http.MethodGet && !user.Torrents {
+		writeAPIError(w, http.StatusForbidden, errors.New("no rights to manage torrents"))
+		return
+	}
+	switch {
+	case path == "torrents" && method == http.MethodGet:
+		apiListTorrents(w, user)
+		return
+	case path == "torrents" && method == http.MethodPost:
+		apiAddTorrent(w, req)
+		return
+	case path == "events" && method == http.MethodGet:
+		apiEvents(w, req)
+		return
+	case path == "limits" && method != http.MethodGet && !user.isRoot():
+		writeAPIError(w, http.StatusForbidden, errors.New("global limits can be changed only by user with root home"))
+		return
+	case path == "limits":
+		apiLimits(w, req, TorrentsDir+"/"+LimitsFile, func() Limits {
+			limitsMu.Lock()
+			defer limitsMu.Unlock()
+			return GlobalLimits
+		}, loadGlobalLimits)
+		return
+	case route[0] != "torrents" || len(route) < 2 || len(route) > 3:
+		writeAPIError(w, http.StatusNotFound, errors.New("unknown API method"))
+		return
+	}
+
+	var infoHash metainfo.Hash
+	if err := infoHash.FromHexString(route[1]); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("wrong infohash: %w", err))
+		return
+	}
+	ts := findTorrent(infoHash)
+	if ts == nil || !user.allowedDir(ts.path) {
+		writeAPIError(w, http.StatusNotFound, errors.New("no such torrent"))
+		return
+	}
+	action := ""
+	if len(route) == 3 {
+		action = route[2]
+	}
+	switch {
+	case action == "" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, torrentInfo(ts, true))
+	case action == "" && method == http.MethodDelete:
+		apiDropTorrent(w, req, ts)
+	case action == "pause" && method == http.MethodPost:
+		apiSetMarker(w, ts, PausedFile, true, updatePaused)
+	case action == "resume" && method == http.MethodPost:
+		apiSetMarker(w, ts, PausedFile, false, updatePaused)
+	case action == "recheck" && method == http.MethodPost:
+		apiSetMarker(w, ts, RecheckFile, true, recheckTorrent)
+	case action == "files" && method == http.MethodPut:
+		apiSetPriorities(w, req, ts)
+	case action == "limits":
+		apiLimits(w, req, ts.path+"/"+LimitsFile, ts.limits.Get, func() { loadTorrentLimits(ts.path) })
+	default:
+		writeAPIError(w, http.StatusNotFound, errors.New("unknown API method"))
+	}
+}
+
+func torrentInfo(ts *TorrentWithStorage, withFiles bool) apiTorrent {
+	trnt := ts.trnt
+	stats := trnt.Stats()
+	info := apiTorrent{
+		InfoHash:     trnt.InfoHash().HexString(),
+		Name:         trnt.Name(),
+		Path:         webDavPath(ts.path),
+		State:        ts.State(),
+		Downloaded:   stats.BytesReadData.Int64(),
+		Uploaded:     stats.BytesWrittenData.Int64(),
+		DownloadRate: ts.downloadRate.Load(),
+		UploadRate:   ts.uploadRate.Load(),
+		Peers: apiPeers{
+			Active:  stats.ActivePeers,
+			Total:   stats.TotalPeers,
+			Seeders: stats.ConnectedSeeders,
+		},
+		Limits:  ts.limits.Get(),
+		Storage: ts.kind,
+	}
+	if err := ts.Err(); err != nil {
+		info.Error = err.Error()
+	}
+	if trnt.Info() == nil {
+		return info
+	}
+	info.Size = trnt.Length()
+	info.Completed = trnt.BytesCompleted()
+	if info.Size > 0 {
+		info.Progress = float64(info.Completed) / float64(info.Size)
+	}
+	if withFiles {
+		for _, f := range trnt.Files() {
+			info.Files = append(info.Files, apiFile{
+				Path:      f.DisplayPath(),
+				Size:      f.Length(),
+				Completed: f.BytesCompleted(),
+				Priority:  priorityName(f.Priority()),
+			})
+		}
+	}
+	return info
+}
+
+func apiListTorrents(w http.ResponseWriter, user *User) {
+	writeJSON(w, http.StatusOK, userTorrents(user))
+}
+
+// Torrents inside home dir of user
+func userTorrents(user *User) []apiTorrent {
+	list := listTorrents()
+	if user.isRoot() {
+		return list
+	}
+	result := make([]apiTorrent, 0, len(list))
+	for _, t := range list {
+		if user.allowed(webDavRel(t.Path, WebDavPath)) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func listTorrents() []apiTorrent {
+	TSmu.Lock()
+	list := make([]*TorrentWithStorage, 0, len(TorrentStorages))
+	for _, ts := range TorrentStorages {
+		list = append(list, ts)
+	}
+	TSmu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].path < list[j].path })
+	result := make([]apiTorrent, 0, len(list))
+	for _, ts := range list {
+		result = append(result, torrentInfo(ts, false))
+	}
+	return result
+}
+
+// Torrent files are removed, so it is not added again on start
+func apiDropTorrent(w http.ResponseWriter, req *http.Request, ts *TorrentWithStorage) {
+	removeData := req.FormValue("data") == "1" || req.FormValue("data") == "true"
+	var dataFiles []string
+	if removeData {
+		err := checkDataRemovable(ts.path)
+		if err == nil {
+			dataFiles, err = torrentDataFiles(ts)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, err)
+			return
+		}
+	}
+	for _, name := range []string{"this.torrent", MagnetFile} {
+		if err := os.Remove(ts.path + "/" + name); err != nil && !os.IsNotExist(err) {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	dropTorrent(ts.path)
+	if removeData {
+		if err := removeTorrentData(ts.path, dataFiles); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Torrent dir can be the torrents dir itself or hold other torrents, their data must stay
+func checkDataRemovable(dir string) error {
+	if dir == TorrentsDir {
+		return errors.New("torrent is in the root of torrents dir, remove its files manually")
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir && isTorrentDir(path) {
+			return fmt.Errorf("torrent dir contains other torrent %s, remove its files manually", path)
+		}
+		return nil
+	})
+}
+
+// Files written next to torrent data
+var torrentSidecarFiles = []string{
+	"this.torrent.part",
+	PausedFile,
+	RecheckFile,
+	FilesFile,
+	FilesFile + ".tmp",
+	LimitsFile,
+	ErrorFile,
+	StorageFile,
+	"bolt.db",
+}
+
+// Data files of the torrent in its dir. Bolt and memory storages don't keep data there
+func torrentDataFiles(ts *TorrentWithStorage) ([]string, error) {
+	info := ts.trnt.Info()
+	if info == nil || ts.kind == "bolt" || ts.kind == "memory" {
+		return nil, nil
+	}
+	var files []string
+	for _, f := range info.UpvertedFiles() {
+		file, err := mmapFilePath(info, f, ts.path)
+		if err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(ts.path, file); err != nil || !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("file %q is outside of torrent dir", file)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Removes data files of the torrent and its sidecar files, then the dir if nothing else is left
+func removeTorrentData(path string, dataFiles []string) error {
+	files := dataFiles
+	for _, name := range torrentSidecarFiles {
+		files = append(files, filepath.Join(path, name))
+	}
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for dir := filepath.Dir(file); dir != path; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	// Deepest first. Not empty dirs have files of user
+	sorted := make([]string, 0, len(dirs)+1)
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, dir := range append(sorted, path) {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// Creates or removes marker file in torrent dir and applies it without waiting for watcher
+func apiSetMarker(w http.ResponseWriter, ts *TorrentWithStorage, name string, set bool, apply func(string)) {
+	var err error
+	if set {
+		err = os.WriteFile(ts.path+"/"+name, nil, 0o644)
+	} else if err = os.Remove(ts.path + "/" + name); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	apply(ts.path)
+	writeJSON(w, http.StatusOK, torrentInfo(ts, false))
+}
+
+func apiSetPriorities(w http.ResponseWriter, req *http.Request, ts *TorrentWithStorage) {
+	if ts.trnt.Info() == nil {
+		writeAPIError(w, http.StatusConflict, errors.New("torrent has no metadata yet"))
+		return
+	}
+	var names map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&names); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	priorities := make(map[string]types.PiecePriority)
+	for file, name := range names {
+		prio, ok := priorityNames[name]
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%q: unknown priority, expected skip, normal or high", name))
+			return
+		}
+		priorities[file] = prio
+	}
+	if err := setFilePriorities(ts, priorities); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, torrentInfo(ts, true))
+}
+
+// GET returns current limits, PUT writes them to `limitsFile` and reloads
+func apiLimits(w http.ResponseWriter, req *http.Request, limitsFile string, get func() Limits, reload func()) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		limits := get()
+		if err := json.NewDecoder(req.Body).Decode(&limits); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if limits.Download < 0 || limits.Upload < 0 {
+			writeAPIError(w, http.StatusBadRequest, errors.New("limits can't be negative"))
+			return
+		}
+		if err := writeLimitsFile(limitsFile, limits); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		reload()
+	default:
+		writeAPIError(w, http.StatusNotFound, errors.New("unknown API method"))
+		return
+	}
+	writeJSON(w, http.StatusOK, get())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		webdavLog.Error().Err(err).Msg("Can't write API response")
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// Path of torrent dir as seen through WebDav
+func webDavPath(dir string) string {
+	prefix, _ := strings.CutPrefix(dir, TorrentsDir)
+	return filepath.Join(WebDavPath, prefix) + "/"
+}
+
+// Accepts magnet link, http(s) URL of torrent file or torrent file itself. It is taken
+// from `uri` query/form parameter, `torrent` multipart file or request body. Optional
+// `dir` parameter is a subdir of torrents dir to add into
+func apiAddTorrent(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, MaxTorrentFileSize)
+	data, err := apiReadTorrent(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	// `..` must not leave the home dir
+	user := requestUser(req)
+	rel := path.Join(user.Home, path.Clean("/"+req.FormValue("dir")))
+	if !user.allowed(rel) {
+		writeAPIError(w, http.StatusForbidden, errors.New("dir is outside of home dir"))
+		return
+	}
+	parent, err := apiTargetDir(rel)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	uri := string(bytes.TrimSpace(data))
+	switch {
+	case strings.HasPrefix(uri, "magnet:"):
+		ts, err := addMagnet(uri, parent)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if ts == nil {
+			magnet, _ := metainfo.ParseMagnetUri(uri)
+			apiExisting(w, magnet.InfoHash)
+			return
+		}
+		go func() {
+			if err := waitMagnet(ts); err != nil {
+				webdavLog.Warn().Err(err).Str("URI", uri).Str("Path", ts.path).Msg("Can't add Magnet")
+				writeFailedMagnet(parent, uri, err)
+			}
+		}()
+		writeJSON(w, http.StatusCreated, apiAdded{ts.trnt.InfoHash().HexString(), webDavPath(ts.path)})
+		return
+	case strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://"):
+		data, err = downloadTorrentFile(uri)
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, err)
+			return
+		}
+	}
+
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("not a magnet, URL or torrent file: %w", err))
+		return
+	}
+	infoHash := mi.HashInfoBytes()
+	if findTorrent(infoHash) != nil {
+		apiExisting(w, infoHash)
+		return
+	}
+	// Not seen by watcher until moved into torrent dir
+	file := parent + "/" + infoHash.HexString() + ".torrent.part"
+	if err = os.WriteFile(file, data, 0o644); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	dir, err := handleNewTorrentFile(file)
+	if err != nil {
+		os.Remove(file)
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+	// Watcher can see the new dir before `this.torrent` is moved into it
+	AddTorrentFile(dir + "/this.torrent")
+	writeJSON(w, http.StatusCreated, apiAdded{infoHash.HexString(), webDavPath(dir)})
+}
+
+func apiExisting(w http.ResponseWriter, infoHash metainfo.Hash) {
+	ts := findTorrent(infoHash)
+	if ts == nil {
+		// Being added right now
+		writeAPIError(w, http.StatusConflict, errors.New("torrent is already added"))
+		return
+	}
+	writeJSON(w, http.StatusConflict, struct {
+		apiError
+		apiAdded
+	}{apiError{"torrent is already added"}, apiAdded{infoHash.HexString(), webDavPath(ts.path)}})
+}
+
+// Subdir of torrents dir, created if missing. Torrent dirs are not allowed
+func apiTargetDir(dir string) (string, error) {
+	target := filepath.Join(TorrentsDir, filepath.Clean("/"+dir))
+	for path := target; path != TorrentsDir && path != "." && path != "/"; path = filepath.Dir(path) {
+		if isTorrentDir(path) {
+			return "", fmt.Errorf("%q is inside of torrent dir", dir)
+		}
+	}
+	return target, os.MkdirAll(target, 0o750)
+}
+
+func apiReadTorrent(req *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Clients like curl send raw body as a form
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	if uri := req.FormValue("uri"); uri != "" {
+		return []byte(uri), nil
+	}
+	if file, _, err := req.FormFile("torrent"); err == nil {
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("expected magnet, URL or torrent file")
+	}
+	return data, nil
+}
+
+func downloadTorrentFile(url string) ([]byte, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MaxTorrentFileSize))
+}
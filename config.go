@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const EnvPrefix = "TRNT2WEBDAV_"
+
+var ConfigPath string
+
+var (
+	// Values from command line, they are not overridden by config file
+	cmdlineFlags = make(map[string]string)
+	// Values taken from config file and environment
+	appliedConfig = make(map[string]string)
+	// Held while options are changed at runtime
+	configMu sync.RWMutex
+)
+
+// Options applied by reloadConfig, with validation of the new value. Others need restart
+var reloadableOptions = map[string]func(string) error{
+	"download-limit": validateRate,
+	"upload-limit":   validateRate,
+	"schedule":       func(s string) error { _, err := parseSchedule(s); return err },
+	"on-add":         nil,
+	"on-complete":    nil,
+	"on-error":       nil,
+	"hook-timeout":   validateDuration,
+	"hook-retries":   validateInt,
+	"magnet-timeout": validateDuration,
+}
+
+// Every key of config file is a name of a command line flag. Nested sections are
+// joined with `-`, so `[log] format = "json"` is the same as `-log-format json`.
+// Lists are joined with `,`.
+//
+// Priority: config file < command line flags < environment variables(TRNT2WEBDAV_*)
+func loadConfig() {
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = f.Value.String()
+	})
+
+	if env, ok := os.LookupEnv(envName("config")); ok {
+		ConfigPath = env
+	}
+	if ConfigPath != "" {
+		values, err := readConfigFile(ConfigPath)
+		if err != nil {
+			log.Fatal().Str("Path", ConfigPath).Err(err).Msg("Can't read config")
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "config" {
+				log.Fatal().Str("Path", ConfigPath).Msg("Option `config` not allowed in config file")
+			}
+			if flag.Lookup(key) == nil {
+				log.Fatal().Str("Path", ConfigPath).Str("Key", key).Msg("Unknown option in config")
+			}
+			if _, ok := cmdlineFlags[key]; ok {
+				continue
+			}
+			if err := flag.Set(key, values[key]); err != nil {
+				log.Fatal().Str("Path", ConfigPath).Str("Key", key).Err(err).Msg("Wrong value in config")
+			}
+			appliedConfig[key] = values[key]
+		}
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := flag.Set(f.Name, value); err != nil {
+			log.Fatal().Str("Env", envName(f.Name)).Err(err).Msg("Wrong value in environment")
+		}
+		appliedConfig[f.Name] = value
+	})
+}
+
+// Re-reads config file and environment. Changed reloadable options are validated and
+// applied all together, others are only reported
+func reloadConfig() error {
+	values := make(map[string]string)
+	if ConfigPath != "" {
+		file, err := readConfigFile(ConfigPath)
+		if err != nil {
+			return fmt.Errorf("can't read %s: %w", ConfigPath, err)
+		}
+		for key, value := range file {
+			if key == "config" || flag.Lookup(key) == nil {
+				return fmt.Errorf("unknown option %q in %s", key, ConfigPath)
+			}
+			if _, ok := cmdlineFlags[key]; !ok {
+				values[key] = value
+			}
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && f.Name != "config" {
+			values[f.Name] = value
+		}
+	})
+
+	changes := make(map[string]string)
+	var restart []string
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := values[f.Name]
+		old, had := appliedConfig[f.Name]
+		if ok == had && value == old {
+			return
+		}
+		if !ok {
+			// Removed from config, back to command line or default
+			value, ok = cmdlineFlags[f.Name]
+			if !ok {
+				value = f.DefValue
+			}
+		}
+		if _, ok := reloadableOptions[f.Name]; !ok {
+			restart = append(restart, f.Name)
+			return
+		}
+		changes[f.Name] = value
+	})
+	if len(restart) > 0 {
+		log.Warn().Strs("Options", restart).Msg("Options changed, restart to apply")
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(changes))
+	for name, value := range changes {
+		if validate := reloadableOptions[name]; validate != nil {
+			if err := validate(value); err != nil {
+				return fmt.Errorf("wrong %s: %w", name, err)
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	configMu.Lock()
+	for _, name := range names {
+		if err := flag.Set(name, changes[name]); err != nil {
+			log.Error().Str("Key", name).Err(err).Msg("Wrong value in config")
+			continue
+		}
+		if value, ok := values[name]; ok {
+			appliedConfig[name] = value
+		} else {
+			delete(appliedConfig, name)
+		}
+	}
+	configMu.Unlock()
+	log.Info().Strs("Options", names).Msg("Config reloaded")
+
+	// Limits are applied by caller
+	if _, ok := changes["schedule"]; ok {
+		loadSchedule()
+	}
+	return nil
+}
+
+func validateRate(s string) error {
+	_, err := parseRate(s)
+	return err
+}
+
+func validateDuration(s string) error {
+	_, err := time.ParseDuration(s)
+	return err
+}
+
+func validateInt(s string) error {
+	_, err := strconv.ParseInt(s, 0, strconv.IntSize)
+	return err
+}
+
+// `log-format`  ->  `TRNT2WEBDAV_LOG_FORMAT`
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Returns flattened `flag name -> value` map. Format is chosen by file extension
+func readConfigFile(path string) (map[string]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(buf, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &raw)
+	case ".json":
+		err = json.Unmarshal(buf, &raw)
+	default:
+		return nil, fmt.Errorf("unknown config format %q, expected .toml, .yaml or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	err = flattenConfig("", raw, result)
+	return result, err
+}
+
+func flattenConfig(prefix string, raw map[string]interface{}, result map[string]string) error {
+	for key, value := range raw {
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flattenConfig(key, v, result); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				str, err := configScalar(item)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				items = append(items, str)
+			}
+			result[key] = strings.Join(items, ",")
+		default:
+			str, err := configScalar(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			result[key] = str
+		}
+	}
+	return nil
+}
+
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		// JSON numbers. Avoid `1e+06`
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFlattenConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "scalars",
+			json: `{"port": 4065, "dht": false, "metadata": "meta", "readahead": 1000000}`,
+			want: map[string]string{"port": "4065", "dht": "false", "metadata": "meta", "readahead": "1000000"},
+		},
+		{
+			name: "nested",
+			json: `{"log": {"format": "json", "max": {"files": 3}}}`,
+			want: map[string]string{"log-format": "json", "log-max-files": "3"},
+		},
+		{
+			name: "list",
+			json: `{"schedule": ["night: 01:00-07:00", "mon-fri download=1MB"]}`,
+			want: map[string]string{"schedule": "night: 01:00-07:00,mon-fri download=1MB"},
+		},
+		{
+			name: "float",
+			json: `{"ratio": 1.5}`,
+			want: map[string]string{"ratio": "1.5"},
+		},
+		{
+			name:    "null",
+			json:    `{"port": null}`,
+			wantErr: true,
+		},
+		{
+			name:    "nested list",
+			json:    `{"schedule": [["a"]]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := make(map[string]interface{})
+			if err := json.Unmarshal([]byte(tt.json), &raw); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			err := flattenConfig("", raw, got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigScalar(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{"10MB", "10MB", false},
+		{true, "true", false},
+		{42, "42", false},
+		{int64(1 << 40), "1099511627776", false},
+		{float64(1e6), "1000000", false},
+		{0.25, "0.25", false},
+		{nil, "", true},
+		{[]int{1}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := configScalar(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("configScalar(%#v) err = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("configScalar(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	oldFlags, oldCmdline, oldApplied, oldPath := flag.CommandLine, cmdlineFlags, appliedConfig, ConfigPath
+	t.Cleanup(func() {
+		flag.CommandLine, cmdlineFlags, appliedConfig, ConfigPath = oldFlags, oldCmdline, oldApplied, oldPath
+	})
+	cmdlineFlags = make(map[string]string)
+	appliedConfig = make(map[string]string)
+	ConfigPath = filepath.Join(t.TempDir(), "config.toml")
+
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var port, retries int
+	var logFormat, download, upload string
+	flag.IntVar(&port, "port", 4065, "")
+	flag.IntVar(&retries, "hook-retries", 3, "")
+	flag.StringVar(&logFormat, "log-format", "console", "")
+	flag.StringVar(&download, "download-limit", "", "")
+	flag.StringVar(&upload, "upload-limit", "", "")
+	if err := flag.CommandLine.Parse([]string{"-upload-limit", "1MB", "-port", "6000"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envName("port"), "7000")
+
+	writeConfig := func(s string) {
+		if err := os.WriteFile(ConfigPath, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`
+port = 5000
+upload-limit = "2MB"
+download-limit = "3MB"
+hook-retries = 5
+[log]
+format = "json"
+`)
+	loadConfig()
+	if port != 7000 || upload != "1MB" || download != "3MB" || retries != 5 || logFormat != "json" {
+		t.Errorf("after load: port %d, upload %q, download %q, retries %d, log format %q", port, upload, download, retries, logFormat)
+	}
+
+	// Removed options are back to flag or default, the ones needing restart are kept
+	writeConfig(`download-limit = "4MB"`)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if port != 7000 || upload != "1MB" || download != "4MB" || retries != 3 || logFormat != "json" {
+		t.Errorf("after reload: port %d, upload %q, download %q, retries %d, log format %q", port, upload, download, retries, logFormat)
+	}
+
+	writeConfig(`download-limit = "fast"`)
+	if err := reloadConfig(); err == nil {
+		t.Error("no error on wrong value")
+	}
+	if download != "4MB" {
+		t.Errorf("download = %q after wrong value", download)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	CtlSocket string
+	ctlServer *http.Server
+	reloadMu  sync.Mutex
+)
+
+const ctlUsage = `Usage: trnt2webdav ctl [-socket path] [-json] command [args]
+
+Commands:
+  status                         client status, the same as stats.txt
+  list                           list torrents
+  add magnet|url|file [dir]      add torrent, into dir inside torrents dir if set
+  pause torrent                  stop downloading and uploading
+  resume torrent                 continue paused torrent
+  drop torrent [-data]           remove torrent, with downloaded data if -data
+  recheck torrent                verify downloaded data
+  limits [torrent] [download=rate] [upload=rate]
+                                 show or set global or torrent speed limits
+  reload                         reload config, users, limits and priorities, scan torrents dir
+
+Torrent is an infohash, its unique prefix or a torrent name.
+`
+
+// Serves API, status and reload on the local Unix socket for `trnt2webdav ctl`
+func initControl() {
+	if CtlSocket == "" {
+		return
+	}
+	if !filepath.IsAbs(CtlSocket) {
+		CtlSocket = filepath.Join(MetaDataDir, CtlSocket)
+	}
+	if _, err := os.Stat(CtlSocket); err == nil {
+		if conn, err := net.Dial("unix", CtlSocket); err == nil {
+			conn.Close()
+			log.Fatal().Str("Path", CtlSocket).Msg("Control socket is in use, already running?")
+		}
+		os.Remove(CtlSocket)
+	}
+	listener, err := net.Listen("unix", CtlSocket)
+	if err != nil {
+		// Server works without it
+		log.Error().Str("Path", CtlSocket).Err(err).Msg("Can't listen control socket")
+		return
+	}
+	if err := os.Chmod(CtlSocket, 0o600); err != nil {
+		log.Error().Str("Path", CtlSocket).Err(err).Msg("Can't set control socket permissions")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		writeStatus(w)
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeAPIError(w, http.StatusNotFound, errors.New("unknown API method"))
+			return
+		}
+		go reload()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc(APIPath+"/", func(w http.ResponseWriter, req *http.Request) {
+		serveAPI(w, req, "")
+	})
+	ctlServer = &http.Server{Handler: mux}
+	go func() {
+		log.Info().Str("Path", CtlSocket).Msg("Control socket")
+		if err := ctlServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error().Str("Path", CtlSocket).Err(err).Msg("Control socket")
+		}
+	}()
+}
+
+func closeControl() {
+	if ctlServer != nil {
+		ctlServer.Close()
+		os.Remove(CtlSocket)
+	}
+}
+
+// Re-reads config, limits and priorities files, reopens log file and scans torrents dir
+// for changes missed by watcher. On SIGHUP and `ctl reload`
+func reload() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	log.Info().Msg("Reloading")
+	if logFile != nil {
+		if err := logFile.Reopen(); err != nil {
+			log.Error().Str("Path", LogFile).Err(err).Msg("Can't reopen log file")
+		}
+	}
+	if err := reloadConfig(); err != nil {
+		log.Error().Err(err).Msg("Config is not reloaded")
+	}
+	if err := loadUsers(); err != nil {
+		log.Error().Str("Path", UsersFile).Err(err).Msg("Users are not reloaded")
+	}
+	loadGlobalLimits()
+	updateAllDataFlow()
+	TSmu.Lock()
+	paths := make([]string, 0, len(TorrentStorages))
+	for path := range TorrentStorages {
+		paths = append(paths, path)
+	}
+	TSmu.Unlock()
+	for _, path := range paths {
+		loadTorrentLimits(path)
+		reloadFilePriorities(path)
+		updatePaused(path)
+	}
+	recursiveScanDir(TorrentsDir)
+}
+
+/////////////////////////////////////////////////////////////////////////////////
+
+type ctlClient struct {
+	http.Client
+	json bool
+}
+
+// `trnt2webdav ctl ...`
+func runCtl(args []string) {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), ctlUsage) }
+	// The same defaults as of server
+	metadata, socket := "metadata", "trnt2webdav.sock"
+	if env, ok := os.LookupEnv(envName("metadata")); ok {
+		metadata = env
+	}
+	if env, ok := os.LookupEnv(envName("ctl-socket")); ok {
+		socket = env
+	}
+	if !filepath.IsAbs(socket) {
+		socket = filepath.Join(metadata, socket)
+	}
+	flags.StringVar(&socket, "socket", socket, "path to control socket of running trnt2webdav")
+	rawJSON := flags.Bool("json", false, "print API responses as is")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c := &ctlClient{json: *rawJSON}
+	c.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}
+	if err := c.run(flags.Arg(0), flags.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func (c *ctlClient) run(command string, args []string) error {
+	switch command {
+	case "status":
+		body, err := c.call(http.MethodGet, "/status", nil)
+		os.Stdout.Write(body)
+		return err
+	case "list":
+		return c.list()
+	case "add":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: add magnet|url|file [dir]")
+		}
+		dir := ""
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		return c.add(args[0], dir)
+	case "pause", "resume", "recheck":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s torrent", command)
+		}
+		return c.action(http.MethodPost, args[0], "/"+command)
+	case "drop":
+		if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "-data") {
+			return errors.New("usage: drop torrent [-data]")
+		}
+		query := ""
+		if len(args) == 2 {
+			query = "?data=1"
+		}
+		return c.action(http.MethodDelete, args[0], query)
+	case "limits":
+		return c.limits(args)
+	case "reload":
+		_, err := c.call(http.MethodPost, "/reload", nil)
+		return err
+	}
+	return fmt.Errorf("unknown command %q, see `trnt2webdav ctl -h`", command)
+}
+
+// Returns response body, or error from API
+func (c *ctlClient) call(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://trnt2webdav"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr apiError
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return nil, errors.New(apiErr.Error)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return data, nil
+}
+
+func (c *ctlClient) print(data []byte, text func()) {
+	if c.json {
+		os.Stdout.Write(data)
+		return
+	}
+	text()
+}
+
+func (c *ctlClient) torrents() ([]apiTorrent, []byte, error) {
+	data, err := c.call(http.MethodGet, APIPath+"/torrents", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var torrents []apiTorrent
+	if err := json.Unmarshal(data, &torrents); err != nil {
+		return nil, nil, err
+	}
+	return torrents, data, nil
+}
+
+// Infohash of torrent by infohash, its prefix or name
+func (c *ctlClient) findTorrent(arg string) (string, error) {
+	if _, err := hex.DecodeString(arg); err == nil && len(arg) == 40 {
+		return strings.ToLower(arg), nil
+	}
+	torrents, _, err := c.torrents()
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	for _, t := range torrents {
+		if t.Name == arg {
+			return t.InfoHash, nil
+		}
+		if strings.HasPrefix(t.InfoHash, strings.ToLower(arg)) {
+			if found != "" {
+				return "", fmt.Errorf("%q matches several torrents", arg)
+			}
+			found = t.InfoHash
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no torrent %q", arg)
+	}
+	return found, nil
+}
+
+func (c *ctlClient) list() error {
+	torrents, data, err := c.torrents()
+	if err != nil {
+		return err
+	}
+	c.print(data, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "INFOHASH\tSTATE\tPROGRESS\tDOWN\tUP\tPEERS\tNAME")
+		for _, t := range torrents {
+			fmt.Fprintf(w, "%s\t%s\t%.1f%%\t%s\t%s\t%d\t%s\n", t.InfoHash, t.State, t.Progress*100,
+				rateString(t.DownloadRate), rateString(t.UploadRate), t.Peers.Active, t.Name)
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+func (c *ctlClient) add(source, dir string) error {
+	body := []byte(source)
+	if !strings.HasPrefix(source, "magnet:") && !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		var err error
+		if body, err = os.ReadFile(source); err != nil {
+			return err
+		}
+	}
+	path := APIPath + "/torrents"
+	if dir != "" {
+		path += "?dir=" + url.QueryEscape(dir)
+	}
+	data, err := c.call(http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	c.print(data, func() {
+		var added apiAdded
+		json.Unmarshal(data, &added)
+		fmt.Println("Added", added.InfoHash, added.Path)
+	})
+	return nil
+}
+
+func (c *ctlClient) action(method, torrent, suffix string) error {
+	infoHash, err := c.findTorrent(torrent)
+	if err != nil {
+		return err
+	}
+	_, err = c.call(method, APIPath+"/torrents/"+infoHash+suffix, nil)
+	return err
+}
+
+func (c *ctlClient) limits(args []string) error {
+	path := APIPath + "/limits"
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		infoHash, err := c.findTorrent(args[0])
+		if err != nil {
+			return err
+		}
+		path = APIPath + "/torrents/" + infoHash + "/limits"
+		args = args[1:]
+	}
+
+	var data []byte
+	var err error
+	if len(args) == 0 {
+		data, err = c.call(http.MethodGet, path, nil)
+	} else {
+		changes := make(map[string]int64)
+		for _, arg := range args {
+			key, value, _ := strings.Cut(arg, "=")
+			if key != "download" && key != "upload" {
+				return fmt.Errorf("expected download=rate or upload=rate, got %q", arg)
+			}
+			if changes[key], err = parseRate(value); err != nil {
+				return fmt.Errorf("wrong %s rate: %w", key, err)
+			}
+		}
+		body, _ := json.Marshal(changes)
+		data, err = c.call(http.MethodPut, path, body)
+	}
+	if err != nil {
+		return err
+	}
+	c.print(data, func() {
+		var limits Limits
+		json.Unmarshal(data, &limits)
+		fmt.Println(limits)
+	})
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
+	"github.com/rs/zerolog/log"
+)
+
+// Event types
+const (
+	EventAdded          = "added"
+	EventMetadata       = "metadata"
+	EventPieceCompleted = "piece-completed"
+	EventFileCompleted  = "file-completed"
+	EventCompleted      = "completed"
+	EventPaused         = "paused"
+	EventResumed        = "resumed"
+	EventError          = "error"
+	EventDropped        = "dropped"
+	EventProgress       = "progress" // Snapshot of all torrents, sent periodically
+)
+
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	InfoHash string    `json:"infohash,omitempty"`
+	Path     string    `json:"path,omitempty"` // WebDav path of torrent dir
+	Data     any       `json:"data,omitempty"`
+}
+
+// Subscribers which don't keep up lose events
+const EventsBuffer = 256
+
+var (
+	eventsMu sync.Mutex
+	// Channel -> piece events are wanted. There are too many of them for big torrents,
+	// so they are sent only on request
+	subscribers = make(map[chan Event]bool)
+)
+
+func publishEvent(eventType string, ts *TorrentWithStorage, data any) {
+	event := Event{
+		Type:     eventType,
+		Time:     time.Now(),
+		InfoHash: ts.trnt.InfoHash().HexString(),
+		Path:     webDavPath(ts.path),
+		Data:     data,
+	}
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for ch, pieces := range subscribers {
+		if eventType == EventPieceCompleted && !pieces {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func subscribeEvents(pieces bool) chan Event {
+	ch := make(chan Event, EventsBuffer)
+	eventsMu.Lock()
+	subscribers[ch] = pieces
+	eventsMu.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan Event) {
+	eventsMu.Lock()
+	delete(subscribers, ch)
+	eventsMu.Unlock()
+}
+
+// Publishes completion of pieces, files and whole torrent
+func (ts *TorrentWithStorage) watchPieces() {
+	trnt := ts.trnt
+	sub := trnt.SubscribePieceStateChanges()
+	defer sub.Close()
+	select {
+	case <-trnt.GotInfo():
+	case <-trnt.Closed():
+		return
+	}
+	files := trnt.Files()
+	fileDone := make([]bool, len(files))
+	for i, f := range files {
+		fileDone[i] = f.BytesCompleted() == f.Length()
+	}
+	pieceDone := make([]bool, trnt.NumPieces())
+	for i := range pieceDone {
+		pieceDone[i] = trnt.PieceState(i).Complete
+	}
+	complete := wantedComplete(trnt)
+	for {
+		var change torrent.PieceStateChange
+		select {
+		case <-trnt.Closed():
+			return
+		case change = <-sub.Values:
+		}
+		// Same state comes several times
+		if change.Complete == pieceDone[change.Index] {
+			continue
+		}
+		pieceDone[change.Index] = change.Complete
+		if !change.Complete {
+			// Evicted from cache or failed recheck
+			complete = false
+			continue
+		}
+		publishEvent(EventPieceCompleted, ts, map[string]int{"piece": change.Index})
+		piece := trnt.Info().Piece(change.Index)
+		for i, f := range files {
+			overlaps := f.Offset() < piece.Offset()+piece.Length() && f.Offset()+f.Length() > piece.Offset()
+			if fileDone[i] || !overlaps || f.BytesCompleted() != f.Length() {
+				continue
+			}
+			fileDone[i] = true
+			publishEvent(EventFileCompleted, ts, map[string]string{"file": f.DisplayPath()})
+		}
+		if !complete && wantedComplete(trnt) {
+			complete = true
+			publishEvent(EventCompleted, ts, nil)
+			runHook("complete", ts, nil)
+		}
+	}
+}
+
+// All files which are not skipped are downloaded. If all are skipped, e.g. in on-demand
+// mode, the whole torrent must be read
+func wantedComplete(trnt *torrent.Torrent) bool {
+	wanted := false
+	for _, f := range trnt.Files() {
+		if f.Priority() == types.PiecePriorityNone {
+			continue
+		}
+		wanted = true
+		if f.BytesCompleted() < f.Length() {
+			return false
+		}
+	}
+	return wanted || trnt.BytesMissing() == 0
+}
+
+// GET `<WebDavPath>/api/v1/events` streams events as Server-Sent Events. Parameters:
+// `types` - comma separated event types to send, all but piece-completed by default,
+// `progress` - seconds between progress snapshots, 0 disables them, 5 by default
+func apiEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	var types map[string]bool
+	if list := req.FormValue("types"); list != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(list, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	interval := 5 * time.Second
+	if s := req.FormValue("progress"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%q: wrong progress interval", s))
+			return
+		}
+		interval = time.Duration(seconds * float64(time.Second))
+	}
+	var progress <-chan time.Time
+	if interval > 0 && (types == nil || types[EventProgress]) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+
+	user := requestUser(req)
+	events := subscribeEvents(types[EventPieceCompleted])
+	defer unsubscribeEvents(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	send := func(event Event) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Error().Err(err).Msg("Can't encode event")
+			return true
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		flusher.Flush()
+		return err == nil
+	}
+	for {
+		var event Event
+		select {
+		case <-req.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case event = <-events:
+			if types != nil && !types[event.Type] {
+				continue
+			}
+			if event.Path != "" && !user.allowed(webDavRel(event.Path, WebDavPath)) {
+				continue
+			}
+		case <-progress:
+			event = Event{Type: EventProgress, Time: time.Now(), Data: userTorrents(user)}
+		}
+		if !send(event) {
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Hook is a shell command or http(s) URL to POST JSON to
+var (
+	HookOnAdd      string
+	HookOnComplete string
+	HookOnError    string
+	HookTimeout    time.Duration
+	HookRetries    int
+)
+
+type hookPayload struct {
+	Event    string `json:"event"` // add, complete or error
+	InfoHash string `json:"infohash"`
+	Name     string `json:"name"`
+	Dir      string `json:"dir"`  // Torrent dir on disk
+	Path     string `json:"path"` // WebDav path of torrent dir
+	Size     int64  `json:"size"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Runs hook for `event` in background
+func runHook(event string, ts *TorrentWithStorage, reason error) {
+	configMu.RLock()
+	hook := map[string]string{
+		"add":      HookOnAdd,
+		"complete": HookOnComplete,
+		"error":    HookOnError,
+	}[event]
+	retries := HookRetries
+	configMu.RUnlock()
+	if hook == "" {
+		return
+	}
+	dir, _ := filepath.Abs(ts.path)
+	payload := hookPayload{
+		Event:    event,
+		InfoHash: ts.trnt.InfoHash().HexString(),
+		Name:     ts.trnt.Name(),
+		Dir:      dir,
+		Path:     webDavPath(ts.path),
+	}
+	if ts.trnt.Info() != nil {
+		payload.Size = ts.trnt.Length()
+	}
+	if reason != nil {
+		payload.Error = reason.Error()
+	}
+	go retryHook(hook, payload, retries)
+}
+
+// Delay before the first retry, doubled for each next one
+var hookRetryDelay = time.Second
+
+// Calls hook until it succeeds, at most `retries` times more
+func retryHook(hook string, payload hookPayload, retries int) error {
+	for attempt := 0; ; attempt++ {
+		err := callHook(hook, payload)
+		if err == nil {
+			log.Debug().Str("Event", payload.Event).Str("Path", payload.Dir).Msg("Hook done")
+			return nil
+		}
+		if attempt >= retries {
+			log.Error().Str("Event", payload.Event).Str("Path", payload.Dir).Err(err).Msg("Hook failed")
+			return err
+		}
+		log.Warn().Str("Event", payload.Event).Str("Path", payload.Dir).Err(err).Int("Attempt", attempt+1).Msg("Hook failed, retrying")
+		time.Sleep(hookRetryDelay << attempt)
+	}
+}
+
+func callHook(hook string, payload hookPayload) error {
+	configMu.RLock()
+	timeout := HookTimeout
+	configMu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", hook)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", hook)
+	}
+	cmd.Env = append(os.Environ(),
+		"TORRENT_EVENT="+payload.Event,
+		"TORRENT_INFOHASH="+payload.InfoHash,
+		"TORRENT_NAME="+payload.Name,
+		"TORRENT_DIR="+payload.Dir,
+		"TORRENT_PATH="+payload.Path,
+		"TORRENT_SIZE="+strconv.FormatInt(payload.Size, 10),
+		"TORRENT_ERROR="+payload.Error,
+	)
+	// Background child of the hook can keep output open after the timeout kills the shell
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
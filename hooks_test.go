@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testPayload = hookPayload{
+	Event:    "complete",
+	InfoHash: "31e1ba0a97e1bf3f081d085c316692a1006688c5",
+	Name:     "Movie",
+	Dir:      "/data/torrents/Movie",
+	Path:     "/Movie/",
+	Size:     1 << 20,
+}
+
+func setHookTimeout(t *testing.T, timeout time.Duration) {
+	configMu.Lock()
+	old := HookTimeout
+	HookTimeout = timeout
+	configMu.Unlock()
+	t.Cleanup(func() {
+		configMu.Lock()
+		HookTimeout = old
+		configMu.Unlock()
+	})
+}
+
+func TestHookPost(t *testing.T) {
+	setHookTimeout(t, 5*time.Second)
+	var got hookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with %q", req.Method, req.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+	if err := callHook(srv.URL, testPayload); err != nil {
+		t.Fatal(err)
+	}
+	if got != testPayload {
+		t.Errorf("got %+v, want %+v", got, testPayload)
+	}
+}
+
+func TestHookRetries(t *testing.T) {
+	setHookTimeout(t, 5*time.Second)
+	hookRetryDelay = time.Millisecond
+	defer func() { hookRetryDelay = time.Second }()
+	var calls atomic.Int32
+	failures := int32(2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	if err := retryHook(srv.URL, testPayload, 2); err != nil {
+		t.Errorf("err = %v after %d calls", err, calls.Load())
+	}
+	if calls.Load() != 3 {
+		t.Errorf("calls = %d, want 3", calls.Load())
+	}
+
+	calls.Store(0)
+	failures = 10
+	if err := retryHook(srv.URL, testPayload, 1); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("err = %v, want 503", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("calls = %d, want 2", calls.Load())
+	}
+}
+
+func TestHookPostTimeout(t *testing.T) {
+	setHookTimeout(t, 100*time.Millisecond)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	start := time.Now()
+	if err := callHook(srv.URL, testPayload); err == nil {
+		t.Error("no error on timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+}
+
+func TestHookCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	setHookTimeout(t, 5*time.Second)
+	out := filepath.Join(t.TempDir(), "env")
+	hook := `echo "$TORRENT_EVENT|$TORRENT_INFOHASH|$TORRENT_NAME|$TORRENT_DIR|$TORRENT_PATH|$TORRENT_SIZE|$TORRENT_ERROR" > ` + out
+	payload := testPayload
+	payload.Error = "disk is full"
+	if err := callHook(hook, payload); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "complete|31e1ba0a97e1bf3f081d085c316692a1006688c5|Movie|/data/torrents/Movie|/Movie/|1048576|disk is full\n"
+	if string(buf) != want {
+		t.Errorf("got %q, want %q", buf, want)
+	}
+
+	err = callHook("echo oops; exit 3", payload)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("err = %v, want exit status with output", err)
+	}
+}
+
+func TestHookCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	setHookTimeout(t, 200*time.Millisecond)
+	start := time.Now()
+	// Background child keeps output open after the shell is killed
+	if err := callHook("sleep 10 & sleep 10", testPayload); err == nil {
+		t.Error("no error on timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+}
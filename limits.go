@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/inhies/go-bytesize"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// Should be not less than chunk size requested by peers(16KB)
+const LimiterBurst = 256 << 10
+
+const LimitsFile = "limits.txt"
+
+var (
+	UploadLimit   string
+	DownloadLimit string
+
+	// Passed to torrent.ClientConfig once, then changed in place
+	UploadLimiter   = rate.NewLimiter(rate.Inf, LimiterBurst)
+	DownloadLimiter = rate.NewLimiter(rate.Inf, LimiterBurst)
+
+	// From flags and limits.txt, without schedule
+	GlobalLimits Limits
+	limitsMu     sync.Mutex
+)
+
+// Bytes per second, 0 means unlimited
+type Limits struct {
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+}
+
+func (l Limits) String() string {
+	return "download " + rateString(l.Download) + ", upload " + rateString(l.Upload)
+}
+
+// Per-torrent limits. Library supports only global limiters, so the download is limited
+// by storage writes, and the upload by pausing it when the budget is exhausted.
+type TorrentLimits struct {
+	mu        sync.Mutex
+	limits    Limits
+	download  *rate.Limiter
+	budget    int64 // Upload bytes allowed until the next tick
+	throttled bool
+}
+
+func NewTorrentLimits() *TorrentLimits {
+	return &TorrentLimits{
+		download: rate.NewLimiter(rate.Inf, LimiterBurst),
+	}
+}
+
+func (tl *TorrentLimits) Set(limits Limits) {
+	tl.mu.Lock()
+	tl.limits = limits
+	tl.budget = limits.Upload
+	tl.mu.Unlock()
+	setLimiter(tl.download, limits.Download)
+}
+
+func (tl *TorrentLimits) Get() Limits {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return tl.limits
+}
+
+// Returns TRUE if upload should be paused
+func (tl *TorrentLimits) Throttled() bool {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return tl.throttled
+}
+
+// Token bucket for the upload. Every second adds `Upload` bytes to the budget and
+// subtracts really uploaded ones
+func (tl *TorrentLimits) watchUpload(trnt *torrent.Torrent, onChange func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := uploadedBytes(trnt)
+	for {
+		select {
+		case <-trnt.Closed():
+			return
+		case <-ticker.C:
+		}
+		written := uploadedBytes(trnt)
+		tl.mu.Lock()
+		changed := false
+		if tl.limits.Upload == 0 {
+			changed = tl.throttled
+			tl.throttled = false
+		} else {
+			tl.budget = min(tl.budget+tl.limits.Upload-(written-last), tl.limits.Upload)
+			throttled := tl.budget <= 0
+			changed = throttled != tl.throttled
+			tl.throttled = throttled
+		}
+		tl.mu.Unlock()
+		last = written
+		if changed {
+			onChange()
+		}
+	}
+}
+
+func uploadedBytes(trnt *torrent.Torrent) int64 {
+	stats := trnt.Stats()
+	return stats.BytesWrittenData.Int64()
+}
+
+func setLimiter(l *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(bytesPerSecond))
+	l.SetBurst(max(LimiterBurst, int(bytesPerSecond)))
+}
+
+// Accepts `512KB`, `1.5MB`, `1048576`. Empty string, `0` or `unlimited` means no limit
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == "unlimited" {
+		return 0, nil
+	}
+	return parseSize(s)
+}
+
+// Accepts `512KB`, `1.5MB`, `1048576`. Empty string is 0
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 {
+			return 0, errors.New("negative size")
+		}
+		return n, nil
+	}
+	b, err := bytesize.Parse(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(b), nil
+}
+
+func rateString(bytesPerSecond int64) string {
+	if bytesPerSecond == 0 {
+		return "unlimited"
+	}
+	return bytesize.New(float64(bytesPerSecond)).String() + "/s"
+}
+
+// File format:
+//
+//	# Comment
+//	download 2MB
+//	upload 512KB
+//
+// Missing keys are taken from `defaults`
+func readLimitsFile(path string, defaults Limits) (Limits, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return defaults, err
+	}
+	defer file.Close()
+	return parseLimits(file, defaults)
+}
+
+func writeLimitsFile(path string, limits Limits) error {
+	data := fmt.Sprintf("# per second, 0 or unlimited - no limit\ndownload %d\nupload %d\n", limits.Download, limits.Upload)
+	return os.WriteFile(path, []byte(data), 0o644)
+}
+
+func parseLimits(r io.Reader, limits Limits) (Limits, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		n, err := parseRate(value)
+		if err != nil {
+			return limits, fmt.Errorf("%q: %w", line, err)
+		}
+		switch strings.ToLower(key) {
+		case "download":
+			limits.Download = n
+		case "upload":
+			limits.Upload = n
+		default:
+			return limits, fmt.Errorf("%q: unknown key, expected download or upload", line)
+		}
+	}
+	return limits, scanner.Err()
+}
+
+// Global limits from flags, overridden by `limits.txt` in the root of TorrentsDir
+func loadGlobalLimits() {
+	var limits Limits
+	var err error
+	configMu.RLock()
+	downloadLimit, uploadLimit := DownloadLimit, UploadLimit
+	configMu.RUnlock()
+	if limits.Download, err = parseRate(downloadLimit); err != nil {
+		log.Fatal().Str("Value", downloadLimit).Err(err).Msg("Wrong download limit")
+	}
+	if limits.Upload, err = parseRate(uploadLimit); err != nil {
+		log.Fatal().Str("Value", uploadLimit).Err(err).Msg("Wrong upload limit")
+	}
+	path := TorrentsDir + "/" + LimitsFile
+	limits, err = readLimitsFile(path, limits)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Str("Path", path).Err(err).Msg("Can't read limits")
+	}
+	limitsMu.Lock()
+	GlobalLimits = limits
+	limitsMu.Unlock()
+	applyGlobalLimits()
+}
+
+// Global limits with the active schedule profile on top
+func applyGlobalLimits() {
+	limitsMu.Lock()
+	limits := GlobalLimits
+	limitsMu.Unlock()
+	profile := ActiveProfile.Load()
+	if profile != nil {
+		limits = profile.Apply(limits)
+	}
+	setLimiter(DownloadLimiter, limits.Download)
+	setLimiter(UploadLimiter, limits.Upload)
+	log.Info().
+		Str("Limits", limits.String()).
+		Str("Profile", profile.String()).
+		Bool("DownloadOff", profile.NoDownload()).
+		Bool("UploadOff", profile.NoUpload()).
+		Msg("Global limits")
+}
+
+// Per-torrent `limits.txt`. Missing file means no own limits
+func loadTorrentLimits(path string) {
+	TSmu.Lock()
+	ts, in := TorrentStorages[path]
+	TSmu.Unlock()
+	if !in {
+		return
+	}
+	limits, err := readLimitsFile(path+"/"+LimitsFile, Limits{})
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Str("Path", path).Err(err).Msg("Can't read torrent limits")
+		return
+	}
+	if ts.limits.Get() != limits {
+		log.Info().Str("Path", path).Str("Limits", limits.String()).Msg("Torrent limits")
+	}
+	ts.limits.Set(limits)
+}
+
+/////////////////////////////////////////////////////////////////////////////////
+
+// Wraps any storage and limits speed of writing downloaded data
+type limitedClientImpl struct {
+	storage.ClientImpl
+	limiter *rate.Limiter
+}
+
+func NewLimitedStorage(impl storage.ClientImpl, limiter *rate.Limiter) storage.ClientImpl {
+	return limitedClientImpl{ClientImpl: impl, limiter: limiter}
+}
+
+func (s limitedClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.ClientImpl.OpenTorrent(info, infoHash)
+	if err != nil {
+		return t, err
+	}
+	piece := t.Piece
+	t.Piece = func(p metainfo.Piece) storage.PieceImpl {
+		return limitedPiece{PieceImpl: piece(p), limiter: s.limiter}
+	}
+	return t, nil
+}
+
+type limitedPiece struct {
+	storage.PieceImpl
+	limiter *rate.Limiter
+}
+
+func (p limitedPiece) WriteAt(b []byte, off int64) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b[:min(len(b), LimiterBurst)]
+		if err = p.limiter.WaitN(context.Background(), len(chunk)); err != nil {
+			return
+		}
+		var written int
+		written, err = p.PieceImpl.WriteAt(chunk, off)
+		n += written
+		if err != nil {
+			return
+		}
+		b = b[written:]
+		off += int64(written)
+	}
+	return
+}
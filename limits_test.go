@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"unlimited", 0, false},
+		{"1048576", 1 << 20, false},
+		{"512KB", 512 << 10, false},
+		{"1.5MB", 3 << 19, false},
+		{" 2MB/s ", 2 << 20, false},
+		{"-1", 0, true},
+		{"fast", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRate(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	defaults := Limits{Download: 100, Upload: 200}
+	tests := []struct {
+		name    string
+		in      string
+		want    Limits
+		wantErr bool
+	}{
+		{"empty", "", defaults, false},
+		{"comments", "# download 1MB\n\n", defaults, false},
+		{"both", "download 1MB\nupload 512KB\n", Limits{Download: 1 << 20, Upload: 512 << 10}, false},
+		{"one", "Upload unlimited", Limits{Download: 100, Upload: 0}, false},
+		{"unknown key", "ratio 2", defaults, true},
+		{"wrong rate", "download fast", defaults, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLimits(strings.NewReader(tt.in), defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
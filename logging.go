@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	torrent_log "github.com/anacrolix/log"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	LogFormat   string
+	LogFile     string
+	LogMaxSize  string
+	LogMaxFiles int
+	LogLevels   string
+)
+
+// Loggers of components with own levels. Everything else uses log.Logger
+var (
+	torrentLog = log.Logger // anacrolix/torrent library
+	watcherLog = log.Logger
+	webdavLog  = log.Logger
+	storageLog = log.Logger
+
+	logFile *rotatingFile
+)
+
+func initLogging() {
+	var out io.Writer = os.Stdout
+	if LogFile != "" {
+		maxSize, err := parseSize(LogMaxSize)
+		if err != nil {
+			log.Fatal().Str("Value", LogMaxSize).Err(err).Msg("Wrong log max size")
+		}
+		file, err := openRotatingFile(LogFile, maxSize, LogMaxFiles)
+		if err != nil {
+			log.Fatal().Str("Path", LogFile).Err(err).Msg("Can't open log file")
+		}
+		out = file
+		logFile = file
+	}
+
+	var base zerolog.Logger
+	switch LogFormat {
+	case "console":
+		base = zerolog.New(zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339, NoColor: LogFile != ""})
+	case "json":
+		base = zerolog.New(out)
+	default:
+		log.Fatal().Str("Value", LogFormat).Msg("Wrong log format, must be json or console")
+	}
+	base = base.With().Timestamp().Logger()
+
+	level := zerolog.InfoLevel
+	torrentLevel := zerolog.WarnLevel
+	if Verbose {
+		level = zerolog.DebugLevel
+		torrentLevel = zerolog.DebugLevel
+	}
+	levels := map[string]zerolog.Level{
+		"torrent": torrentLevel,
+		"watcher": level,
+		"webdav":  level,
+		"storage": level,
+	}
+	for _, rule := range strings.Split(LogLevels, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(rule, "=")
+		name = strings.TrimSpace(name)
+		if _, ok := levels[name]; !ok {
+			log.Fatal().Str("Value", rule).Msg("Unknown log component, must be torrent, watcher, webdav or storage")
+		}
+		componentLevel, err := zerolog.ParseLevel(strings.TrimSpace(value))
+		if err != nil || value == "" {
+			log.Fatal().Str("Value", rule).Msg("Wrong log level, must be trace, debug, info, warn, error or disabled")
+		}
+		levels[name] = componentLevel
+	}
+
+	log.Logger = base.Level(level)
+	component := func(name string) zerolog.Logger {
+		return base.With().Str("Component", name).Logger().Level(levels[name])
+	}
+	torrentLog = component("torrent")
+	watcherLog = component("watcher")
+	webdavLog = component("webdav")
+	storageLog = component("storage")
+}
+
+// Filter level for anacrolix/torrent, so skipped messages are not even formatted
+func torrentLogFilter() torrent_log.Level {
+	switch torrentLog.GetLevel() {
+	case zerolog.TraceLevel, zerolog.DebugLevel:
+		return torrent_log.Debug
+	case zerolog.InfoLevel:
+		return torrent_log.Info
+	case zerolog.WarnLevel:
+		return torrent_log.Warning
+	case zerolog.ErrorLevel:
+		return torrent_log.Error
+	default:
+		return torrent_log.Critical
+	}
+}
+
+// Log file which is moved to path.1 when it grows over maxSize, path.1 to path.2 and so on.
+// Only maxFiles old files are kept
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Can't rotate log file:", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Opens the file again, after it was moved by logrotate. The old one is kept on error
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// The current file is written further if rotation fails
+func (f *rotatingFile) rotate() error {
+	if f.maxFiles < 1 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+		for i := f.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Lines which failed are moved there with the reason
+const MagnetFailedFile = "magnet.failed.txt"
+
+// Holds magnet link in torrent dir until metadata is received
+const MagnetFile = "this.magnet"
+
+var MagnetTimeout time.Duration
+
+// Magnets resolved at once, other lines of magnet.txt wait
+const MagnetWorkers = 16
+
+var (
+	magnetsMu sync.Mutex // Guards magnet files, `resolving` and `queuedMagnets`
+	resolving = make(map[metainfo.Hash]bool)
+	// Lines of magnet.txt being resolved. One save gives several events, each parses the file
+	queuedMagnets = make(map[magnetLine]bool)
+	magnetSlots   = make(chan struct{}, MagnetWorkers)
+)
+
+type magnetLine struct {
+	file, uri string
+}
+
+// File format:
+//
+//	# Comment
+//	magnet:?xt=urn:btih:...
+//
+// Magnets are resolved concurrently. Every line ends up as a torrent dir next to
+// `magnet.txt` or in `magnet.failed.txt`, then it's removed from `magnet.txt`
+func parseMagnetsFile(path string) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		time.Sleep(time.Second * 3)
+		buf, err = os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Error().Err(err).Str("Path", path).Msg("Can't read file")
+			}
+			return
+		}
+	}
+	log.Info().Str("Path", path).Msg("Parsing Magnets file")
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key := magnetLine{file: path, uri: line}
+		magnetsMu.Lock()
+		queued := queuedMagnets[key]
+		queuedMagnets[key] = true
+		magnetsMu.Unlock()
+		if queued {
+			continue
+		}
+		go func() {
+			magnetSlots <- struct{}{}
+			err := resolveMagnet(line, filepath.Dir(path))
+			<-magnetSlots
+			if err != nil {
+				log.Warn().Err(err).Str("URI", line).Str("File", path).Msg("Can't add Magnet")
+				writeFailedMagnet(filepath.Dir(path), line, err)
+			}
+			removeMagnetLine(key)
+		}()
+	}
+}
+
+// Adds magnet into new dir in `parent` and waits for metadata
+func resolveMagnet(uri, parent string) error {
+	ts, err := addMagnet(uri, parent)
+	if ts == nil {
+		return err
+	}
+	return waitMagnet(ts)
+}
+
+// Creates dir for magnet in `parent` and starts torrent there. Until metadata arrives the
+// dir holds `this.magnet`. Returns nil if torrent is already added
+func addMagnet(uri, parent string) (*TorrentWithStorage, error) {
+	spec, err := torrent.TorrentSpecFromMagnetUri(uri)
+	if err != nil {
+		return nil, err
+	}
+	// New dir is found by watcher too, it must leave the dir to us
+	if !claimMagnet(spec.InfoHash) {
+		log.Info().Str("URI", uri).Msg("Magnet is already added")
+		return nil, nil
+	}
+	defer releaseMagnet(spec.InfoHash)
+
+	name := spec.InfoHash.HexString()
+	if safeName, err := storage.ToSafeFilePath(spec.DisplayName); err == nil && spec.DisplayName != "" {
+		name = safeName
+	}
+	dir := parent + "/" + name
+	err = os.Mkdir(dir, 0o750)
+	if os.IsExist(err) {
+		dir += "-" + spec.InfoHash.HexString()[:8]
+		err = os.Mkdir(dir, 0o750)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(dir+"/"+MagnetFile, []byte(uri+"\n"), 0o644); err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	log.Info().Str("Path", dir).Msg("Magnet added")
+	ts := addTorrent(spec, dir)
+	if ts == nil {
+		os.Remove(dir + "/" + MagnetFile)
+		os.Remove(dir)
+		return nil, errors.New("can't add torrent, see log")
+	}
+	return ts, nil
+}
+
+// Waits for metadata. Torrent is dropped on timeout
+func waitMagnet(ts *TorrentWithStorage) error {
+	configMu.RLock()
+	timeout := MagnetTimeout
+	configMu.RUnlock()
+	select {
+	case <-ts.trnt.GotInfo():
+	case <-ts.trnt.Closed():
+		return nil
+	case <-time.After(timeout):
+		dropTorrent(ts.path)
+		os.Remove(ts.path + "/" + MagnetFile)
+		os.Remove(ts.path)
+		return fmt.Errorf("no metadata in %s", timeout)
+	}
+	ts.gotInfo(true)
+	return nil
+}
+
+// Called for dir with `this.magnet` found by watcher, e.g. on start
+func addMagnetDir(dir string) {
+	buf, err := os.ReadFile(dir + "/" + MagnetFile)
+	uri := strings.TrimSpace(string(buf))
+	var spec *torrent.TorrentSpec
+	if err == nil {
+		spec, err = torrent.TorrentSpecFromMagnetUri(uri)
+	}
+	if err == nil {
+		if !claimMagnet(spec.InfoHash) {
+			// Being added by addMagnet, or already added
+			return
+		}
+		ts := addTorrent(spec, dir)
+		releaseMagnet(spec.InfoHash)
+		if ts == nil {
+			return
+		}
+		err = waitMagnet(ts)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("URI", uri).Str("Path", dir).Msg("Can't add Magnet")
+		writeFailedMagnet(filepath.Dir(dir), uri, err)
+	}
+}
+
+// Marks magnet as being added until releaseMagnet. Returns false if it's already added or
+// is being added, so the same torrent doesn't get two dirs
+func claimMagnet(infoHash metainfo.Hash) bool {
+	magnetsMu.Lock()
+	defer magnetsMu.Unlock()
+	if findTorrent(infoHash) != nil || resolving[infoHash] {
+		return false
+	}
+	resolving[infoHash] = true
+	return true
+}
+
+// Called once torrent is in TorrentStorages, or failed
+func releaseMagnet(infoHash metainfo.Hash) {
+	magnetsMu.Lock()
+	delete(resolving, infoHash)
+	magnetsMu.Unlock()
+}
+
+// Writes `this.torrent` for torrent added from magnet
+func saveTorrentFile(dir string, trnt *torrent.Torrent) {
+	var torrentFile bytes.Buffer
+	err := trnt.Metainfo().Write(&torrentFile)
+	if err == nil {
+		err = os.WriteFile(dir+"/this.torrent.part", torrentFile.Bytes(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(dir+"/this.torrent.part", dir+"/this.torrent")
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Path", dir).Msg("Can't save torrent file from Magnet")
+		return
+	}
+	os.Remove(dir + "/" + MagnetFile)
+}
+
+func findTorrent(infoHash metainfo.Hash) *TorrentWithStorage {
+	TSmu.Lock()
+	defer TSmu.Unlock()
+	for _, ts := range TorrentStorages {
+		if ts.trnt.InfoHash() == infoHash {
+			return ts
+		}
+	}
+	return nil
+}
+
+func writeFailedMagnet(dir, uri string, reason error) {
+	magnetsMu.Lock()
+	defer magnetsMu.Unlock()
+	file, err := os.OpenFile(dir+"/"+MagnetFailedFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err == nil {
+		_, err = fmt.Fprintf(file, "# %s: %s\n%s\n", time.Now().Format(time.DateTime), reason, uri)
+		file.Close()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("URI", uri).Msg("Can't save failed Magnet")
+	}
+}
+
+// Other lines, e.g. added while the magnet was resolved, are kept
+func removeMagnetLine(key magnetLine) {
+	magnetsMu.Lock()
+	defer magnetsMu.Unlock()
+	delete(queuedMagnets, key)
+	buf, err := os.ReadFile(key.file)
+	if err != nil {
+		return
+	}
+	var left []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.TrimSpace(line) != key.uri && strings.TrimSpace(line) != "" {
+			left = append(left, line)
+		}
+	}
+	if len(left) == 0 {
+		os.Remove(key.file)
+		return
+	}
+	err = os.WriteFile(key.file, []byte(strings.Join(left, "\n")+"\n"), 0o644)
+	if err != nil {
+		log.Error().Err(err).Str("Path", key.file).Msg("Can't update Magnets file")
+	}
+}
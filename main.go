@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -23,6 +24,24 @@ var (
 	MetaDataDir string
 	TorrentsDir string
 
+	ListenPort   int
+	Seed         bool
+	EnableDHT    bool
+	EnablePEX    bool
+	EnableUTP    bool
+	EnableTCP    bool
+	EnableIPv4   bool
+	EnableIPv6   bool
+	Encryption   string
+	MaxConns     int
+	PeerIDPrefix string
+
+	OnDemand       bool
+	Readahead      string
+	ReadaheadBytes int64
+
+	ShutdownTimeout time.Duration
+
 	TorrentClient *torrent.Client
 	Server        *WebDAVServer
 	Verbose       bool
@@ -40,21 +59,71 @@ func ensureDirExists(path string) bool {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		runCtl(os.Args[2:])
+		return
+	}
+
 	flag.StringVar(&WebDavAddr, "l", "127.0.0.1:8080", "interface:port for WebDav server to listen")
 	flag.StringVar(&WebDavPath, "s", "", "secret URL path for WebDav access")
 	flag.StringVar(&Username, "user", "", "HTTP Basic Auth Username. if empty, no auth")
 	flag.StringVar(&Password, "pass", "", "HTTP Basic Auth Password")
+	flag.StringVar(&UsersFile, "users", "", "file with users, their home dirs and rights, one per line: name:bcrypt or argon2id hash:home:ro|rw[,torrents]. Reloaded on SIGHUP")
 	flag.StringVar(&MetaDataDir, "metadata", "metadata", "path to the folder for storing torrents metadata")
 	flag.StringVar(&TorrentsDir, "torrents", "torrents", "path to folder for store/watch *.torrent files and magnets.txt")
 	flag.BoolVar(&Verbose, "v", false, "Verbose - print DBG messages")
+	flag.IntVar(&ListenPort, "port", 4065, "port for incoming BitTorrent connections")
+	flag.BoolVar(&Seed, "seed", true, "continue uploading to peers after download completes")
+	flag.BoolVar(&EnableDHT, "dht", true, "enable DHT")
+	flag.BoolVar(&EnablePEX, "pex", true, "enable peer exchange")
+	flag.BoolVar(&EnableUTP, "utp", true, "enable uTP connections")
+	flag.BoolVar(&EnableTCP, "tcp", true, "enable TCP connections")
+	flag.BoolVar(&EnableIPv4, "ipv4", true, "enable IPv4")
+	flag.BoolVar(&EnableIPv6, "ipv6", true, "enable IPv6")
+	flag.StringVar(&Encryption, "encryption", "prefer", "header obfuscation: prefer, require or disable")
+	flag.IntVar(&MaxConns, "max-conns", 50, "maximum established connections per torrent")
+	flag.StringVar(&PeerIDPrefix, "peer-id-prefix", "", "fixed peer ID prefix(BEP 20), e.g. -TW0001-. The rest of ID is random")
+	flag.StringVar(&DownloadLimit, "download-limit", "", "global download limit per second, e.g. 2MB. Overridden by limits.txt in torrents dir")
+	flag.StringVar(&UploadLimit, "upload-limit", "", "global upload limit per second, e.g. 512KB. Overridden by limits.txt in torrents dir")
+	flag.StringVar(&ScheduleRules, "schedule", "", "comma separated bandwidth profiles, e.g. \"night: 01:00-07:00 download=0, mon-fri 09:00-18:00 download=512KB, sat-sun upload=off\"")
+	flag.BoolVar(&OnDemand, "on-demand", false, "don't download torrents, only the parts read through WebDav. Files marked in files.txt are still downloaded")
+	flag.StringVar(&Readahead, "readahead", "", "how much to download ahead of the WebDav reader, e.g. 16MB. Empty - library default")
+	flag.StringVar(&StorageType, "storage", "mmap", "storage for torrent data: mmap, file, bolt, memory(implies -on-demand) or cache(limited by -cache-size, implies -on-demand). Overridden by storage.txt in torrent dir or its parents")
+	flag.StringVar(&Allocation, "allocation", AllocSparse, "disk space allocation for mmap storage: sparse, full(reserve when torrent added) or first-write(reserve file on first write into it)")
+	flag.StringVar(&CacheSize, "cache-size", "4GB", "disk space for cache storage. Least recently used pieces are removed")
+	flag.BoolVar(&RecheckAll, "recheck-all", false, "verify data of all torrents on start. For one torrent create file recheck in its dir")
+	flag.DurationVar(&MagnetTimeout, "magnet-timeout", 10*time.Minute, "how long to wait for magnet metadata. Failed magnets are moved to magnet.failed.txt")
+	flag.StringVar(&HookOnAdd, "on-add", "", "command or http(s) URL for JSON POST, called when torrent gets metadata. Command gets TORRENT_INFOHASH, TORRENT_NAME, TORRENT_DIR, TORRENT_SIZE env")
+	flag.StringVar(&HookOnComplete, "on-complete", "", "the same as -on-add, called when torrent is downloaded")
+	flag.StringVar(&HookOnError, "on-error", "", "the same as -on-add, called on storage error. TORRENT_ERROR has the reason")
+	flag.DurationVar(&HookTimeout, "hook-timeout", 30*time.Second, "time limit for one hook call")
+	flag.IntVar(&HookRetries, "hook-retries", 3, "how many times to retry failed hook")
+	flag.BoolVar(&Metrics, "metrics", false, "serve Prometheus metrics on /metrics of WebDav server, outside of secret path. Basic auth is required if set")
+	flag.StringVar(&MetricsAddr, "metrics-addr", "", "serve Prometheus metrics on separate address without auth, e.g. 127.0.0.1:9090")
+	flag.StringVar(&LogFormat, "log-format", "console", "log format: console or json")
+	flag.StringVar(&LogFile, "log-file", "", "write log to file instead of stdout")
+	flag.StringVar(&LogMaxSize, "log-max-size", "10MB", "rotate log file when it grows over this size. 0 - never")
+	flag.IntVar(&LogMaxFiles, "log-max-files", 5, "how many rotated log files to keep, as file.1, file.2 ...")
+	flag.StringVar(&LogLevels, "log-levels", "", "comma separated levels of components: torrent(library, default warn), watcher, webdav, storage. E.g. \"torrent=error,webdav=debug\"")
+	flag.StringVar(&CtlSocket, "ctl-socket", "trnt2webdav.sock", "unix socket for trnt2webdav ctl commands, relative to metadata dir. Empty - disabled")
+	flag.DurationVar(&ShutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for active WebDav requests on exit")
+	flag.StringVar(&TLSCert, "tls-cert", "", "certificate file for HTTPS and HTTP/2, reloaded on change. Also needs -tls-key")
+	flag.StringVar(&TLSKey, "tls-key", "", "private key file for -tls-cert")
+	flag.BoolVar(&TLSSelfSigned, "tls-self-signed", false, "HTTPS with self-signed certificate, generated in tls dir inside metadata dir. Ignored with -tls-cert")
+	flag.StringVar(&TLSRedirect, "tls-redirect", "", "interface:port for plain HTTP, which redirects to HTTPS, e.g. 0.0.0.0:80")
+	flag.StringVar(&ConfigPath, "config", "", "path to config file(*.toml, *.yaml, *.json). Flags override it, env TRNT2WEBDAV_* override both")
 	flag.Parse()
 
+	// SIGHUP reloads config. Caught from the start, so it doesn't kill the process
+	// before the handler is ready
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
-	if Verbose {
-		log.Logger = log.Level(zerolog.DebugLevel)
-	} else {
-		log.Logger = log.Level(zerolog.InfoLevel)
-	}
+	loadConfig()
+	initLogging()
+	// Paths of torrents are compared with it, so `./torrents` or `torrents/` must match
+	TorrentsDir = filepath.Clean(TorrentsDir)
 
 	if WebDavPath != "" {
 		if !strings.HasPrefix(WebDavPath, "/") {
@@ -72,38 +141,74 @@ func main() {
 		os.WriteFile(TorrentsDir+"/stats.txt", []byte("Only for WebDav server"), os.ModePerm)
 	}
 
+	if err := loadUsers(); err != nil {
+		log.Fatal().Str("Path", UsersFile).Err(err).Msg("Can't load users")
+	}
+	loadSchedule()
+	initStorage()
+	var err error
+	if ReadaheadBytes, err = parseSize(Readahead); err != nil {
+		log.Fatal().Str("Value", Readahead).Err(err).Msg("Wrong readahead")
+	}
 	TorrentClient = InitTorrentClient()
 	Server = NewWebDAVServer(WebDavAddr, WebDavPath)
 
 	//
 	initWatcher()
+	initTLS()
 	recursiveScanDir(TorrentsDir)
+	if RecheckAll {
+		recheckAll()
+	}
+	go runScheduler()
 	log.Info().Int("Count", len(TorrentClient.Torrents())).Msg("Torrents")
 	go Server.Run()
 
+	initControl()
+
+	// Including one received while starting
+	go func() {
+		for range hangup {
+			reload()
+		}
+	}()
+
 	// Ctrl+C
 	interrupt := make(chan os.Signal, 1) // we need to reserve to buffer size 1, so the notifier are not blocked
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
 	go func() {
 		<-interrupt
-		log.Info().Msg("Shutting down...")
-		errs := TorrentClient.Close()
-		for _, err := range errs {
-			log.Error().Err(err).Msg("TorrentClient.Close()")
-		}
-		PieceCompletion.Close()
-		Watcher.Close()
-		os.Exit(0)
+		log.Warn().Msg("Forced shutdown")
+		os.Exit(1)
 	}()
+	shutdown()
+}
 
-	// Write stats on ENTER
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		_ = scanner.Text()
-		TorrentClient.WriteStatus(os.Stdout)
+// Stops WebDAV and waits for active streams, then closes torrents with their storages
+func shutdown() {
+	log.Info().Str("Timeout", ShutdownTimeout.String()).Msg("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	closeControl()
+	closeMetrics()
+	Server.Shutdown(ctx)
+	if ctx.Err() != nil {
+		// Interrupted requests need a moment to close their readers
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+	}
+	if !waitReaders(ctx) {
+		log.Warn().Msg("Some torrent files are still read, closing anyway")
+	}
+	flushMMapStorages()
+	errs := TorrentClient.Close()
+	for _, err := range errs {
+		log.Error().Err(err).Msg("TorrentClient.Close()")
+	}
+	if err := PieceCompletion.Close(); err != nil {
+		log.Error().Err(err).Msg("PieceCompletion.Close()")
 	}
-	// For non-interactive environment, like containers. Just infinity waiting
-	println("AFF")
-	time.Sleep(time.Hour * 24 * 365 * 100)
-	println("AFF2")
+	Watcher.Close()
+	log.Info().Msg("Stopped")
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	Metrics     bool
+	MetricsAddr string // Separate listen address for /metrics
+
+	metricsServer *http.Server
+)
+
+var (
+	webDavRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trnt2webdav_webdav_requests_total",
+		Help: "WebDav requests by method and handler: torrent (streaming from torrent), main (files on disk), stats, api.",
+	}, []string{"method", "handler"})
+	webDavDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trnt2webdav_webdav_request_duration_seconds",
+		Help:    "WebDav request latency by method and handler.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"method", "handler"})
+	activeReaders = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "trnt2webdav_active_readers",
+		Help: "Files being read from torrents through WebDav.",
+	})
+	storageErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "trnt2webdav_storage_errors_total",
+		Help: "Failed writes and completion updates of torrent storages.",
+	})
+)
+
+func observeRequest(method, handler string, start time.Time) {
+	webDavRequests.WithLabelValues(method, handler).Inc()
+	webDavDuration.WithLabelValues(method, handler).Observe(time.Since(start).Seconds())
+}
+
+// Collects torrent metrics on scrape
+type torrentCollector struct{}
+
+var torrentLabels = []string{"infohash", "name"}
+
+var (
+	torrentSize = prometheus.NewDesc("trnt2webdav_torrent_size_bytes",
+		"Size of torrent data.", torrentLabels, nil)
+	torrentCompleted = prometheus.NewDesc("trnt2webdav_torrent_completed_bytes",
+		"Downloaded and verified bytes.", torrentLabels, nil)
+	torrentPeers = prometheus.NewDesc("trnt2webdav_torrent_peers",
+		"Connected peers.", torrentLabels, nil)
+	torrentSeeders = prometheus.NewDesc("trnt2webdav_torrent_seeders",
+		"Connected seeders.", torrentLabels, nil)
+	torrentDownloaded = prometheus.NewDesc("trnt2webdav_torrent_downloaded_bytes_total",
+		"Data downloaded from peers since start.", torrentLabels, nil)
+	torrentUploaded = prometheus.NewDesc("trnt2webdav_torrent_uploaded_bytes_total",
+		"Data uploaded to peers since start.", torrentLabels, nil)
+	torrentDownloadRate = prometheus.NewDesc("trnt2webdav_torrent_download_rate_bytes",
+		"Download speed, bytes per second.", torrentLabels, nil)
+	torrentUploadRate = prometheus.NewDesc("trnt2webdav_torrent_upload_rate_bytes",
+		"Upload speed, bytes per second.", torrentLabels, nil)
+)
+
+func (torrentCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{torrentSize, torrentCompleted, torrentPeers, torrentSeeders,
+		torrentDownloaded, torrentUploaded, torrentDownloadRate, torrentUploadRate} {
+		ch <- desc
+	}
+}
+
+func (torrentCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, info := range listTorrents() {
+		labels := []string{info.InfoHash, info.Name}
+		gauge := func(desc *prometheus.Desc, value int64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), labels...)
+		}
+		counter := func(desc *prometheus.Desc, value int64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+		}
+		gauge(torrentSize, info.Size)
+		gauge(torrentCompleted, info.Completed)
+		gauge(torrentPeers, int64(info.Peers.Active))
+		gauge(torrentSeeders, int64(info.Peers.Seeders))
+		counter(torrentDownloaded, info.Downloaded)
+		counter(torrentUploaded, info.Uploaded)
+		gauge(torrentDownloadRate, info.DownloadRate)
+		gauge(torrentUploadRate, info.UploadRate)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(webDavRequests, webDavDuration, activeReaders, storageErrors, torrentCollector{})
+}
+
+// Serves /metrics on separate address if set, or on WebDav server outside of WebDavPath
+func initMetrics(smux *http.ServeMux) {
+	if MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsServer = &http.Server{Addr: MetricsAddr, Handler: mux}
+		go func() {
+			log.Info().Str("addr", "http://"+MetricsAddr+"/metrics").Msg("Metrics server started")
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("Metrics server")
+			}
+		}()
+		return
+	}
+	if Metrics {
+		handler := promhttp.Handler()
+		smux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+			user := authenticate(w, req)
+			if user == nil {
+				return
+			}
+			if !user.isRoot() {
+				http.Error(w, "Outside of home dir", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, req)
+		})
+	}
+}
+
+// Stops separate metrics server on shutdown
+func closeMetrics() {
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
+	"github.com/rs/zerolog/log"
+)
+
+const FilesFile = "files.txt"
+
+// Priority of files not listed in `files.txt`
+func defaultPriority(onDemand bool) types.PiecePriority {
+	if onDemand {
+		return types.PiecePriorityNone
+	}
+	return types.PiecePriorityNormal
+}
+
+var priorityNames = map[string]types.PiecePriority{
+	"skip":   types.PiecePriorityNone,
+	"normal": types.PiecePriorityNormal,
+	"high":   types.PiecePriorityHigh,
+}
+
+func priorityName(prio types.PiecePriority) string {
+	for name, p := range priorityNames {
+		if p == prio {
+			return name
+		}
+	}
+	return "normal"
+}
+
+const filesHeader = "# Priorities: default, skip, normal, high. Edit and save to apply"
+
+// File format:
+//
+//	# Comment
+//	skip Season 1/ep01.mkv
+//	high Season 1/ep02.mkv
+//	default Season 1/ep03.mkv
+//
+// Files not listed or marked `default` have normal priority, or skip in on-demand mode
+func readFilesFile(path string) (map[string]types.PiecePriority, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	priorities := make(map[string]types.PiecePriority)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, filePath, _ := strings.Cut(line, " ")
+		if strings.EqualFold(name, "default") {
+			continue
+		}
+		prio, ok := priorityNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("%q: unknown priority, expected default, skip, normal or high", line)
+		}
+		priorities[strings.TrimSpace(filePath)] = prio
+	}
+	return priorities, scanner.Err()
+}
+
+// Files without explicit priority are written as `default`
+func writeFilesFile(path string, trnt *torrent.Torrent, priorities map[string]types.PiecePriority) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, filesHeader)
+	for _, f := range trnt.Files() {
+		name := "default"
+		if prio, in := priorities[f.DisplayPath()]; in {
+			name = priorityName(prio)
+		}
+		fmt.Fprintf(w, "%s %s\n", name, f.DisplayPath())
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Watcher must see complete file
+func replaceFilesFile(dir string, trnt *torrent.Torrent, priorities map[string]types.PiecePriority) error {
+	tmp := dir + "/" + FilesFile + ".tmp"
+	os.Remove(tmp)
+	if err := writeFilesFile(tmp, trnt, priorities); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir+"/"+FilesFile)
+}
+
+// Applies `files.txt` from torrent dir. Creates it if not exists
+func applyFilePriorities(path string, ts *TorrentWithStorage) {
+	trnt := ts.trnt
+	if trnt.Info() == nil {
+		return
+	}
+	filesPath := path + "/" + FilesFile
+	priorities, err := readFilesFile(filesPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Str("Path", filesPath).Err(err).Msg("Can't read file priorities")
+		return
+	}
+	skipped := 0
+	for _, f := range trnt.Files() {
+		prio, in := priorities[f.DisplayPath()]
+		if !in {
+			prio = defaultPriority(ts.onDemand)
+		}
+		if prio == types.PiecePriorityNone {
+			skipped++
+		}
+		f.SetPriority(prio)
+	}
+	if os.IsNotExist(err) {
+		if err := writeFilesFile(filesPath, trnt, nil); err != nil && !os.IsExist(err) {
+			log.Error().Str("Path", filesPath).Err(err).Msg("Can't create file priorities")
+		}
+		return
+	}
+	log.Info().Str("Path", path).Int("Skipped", skipped).Int("Files", len(trnt.Files())).Msg("File priorities applied")
+}
+
+// Called by watcher when `files.txt` changed
+func reloadFilePriorities(path string) {
+	TSmu.Lock()
+	ts, in := TorrentStorages[path]
+	TSmu.Unlock()
+	if !in {
+		return
+	}
+	applyFilePriorities(path, ts)
+}
+
+// Sets priorities of listed files and saves them to `files.txt`
+func setFilePriorities(ts *TorrentWithStorage, priorities map[string]types.PiecePriority) error {
+	files := make(map[string]*torrent.File)
+	for _, f := range ts.trnt.Files() {
+		files[f.DisplayPath()] = f
+	}
+	for name := range priorities {
+		if files[name] == nil {
+			return fmt.Errorf("%q: no such file in torrent", name)
+		}
+	}
+	// Keep other explicit priorities
+	saved, err := readFilesFile(ts.path + "/" + FilesFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if saved == nil {
+		saved = make(map[string]types.PiecePriority)
+	}
+	for name, prio := range priorities {
+		files[name].SetPriority(prio)
+		saved[name] = prio
+	}
+	return replaceFilesFile(ts.path, ts.trnt, saved)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/anacrolix/torrent/types"
+)
+
+func TestReadFilesFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]types.PiecePriority
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			content: filesHeader + "\n\n",
+			want:    map[string]types.PiecePriority{},
+		},
+		{
+			name:    "priorities",
+			content: "skip Season 1/ep01.mkv\nHIGH Season 1/ep02.mkv\nnormal  sample.txt \n",
+			want: map[string]types.PiecePriority{
+				"Season 1/ep01.mkv": types.PiecePriorityNone,
+				"Season 1/ep02.mkv": types.PiecePriorityHigh,
+				"sample.txt":        types.PiecePriorityNormal,
+			},
+		},
+		{
+			name:    "default",
+			content: filesHeader + "\ndefault a.mkv\nDefault b.mkv\nhigh c.mkv\n",
+			want:    map[string]types.PiecePriority{"c.mkv": types.PiecePriorityHigh},
+		},
+		{
+			name:    "unknown priority",
+			content: "later ep03.mkv\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), FilesFile)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readFilesFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFilesFileMissing(t *testing.T) {
+	_, err := readFilesFile(filepath.Join(t.TempDir(), FilesFile))
+	if !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
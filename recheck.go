@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Marker file in torrent dir. Torrent data is verified and the file is removed
+const RecheckFile = "recheck"
+
+var RecheckAll bool
+
+// Verifies all pieces and updates their completion. Progress is shown in status
+func (ts *TorrentWithStorage) recheck() {
+	if ts.trnt.Info() == nil || ts.rechecking.Swap(true) {
+		return
+	}
+	ts.checked.Store(0)
+	start := time.Now()
+	log.Info().Str("Path", ts.path).Msg("Recheck started")
+	for i := 0; i < ts.trnt.NumPieces(); i++ {
+		select {
+		case <-ts.trnt.Closed():
+			ts.rechecking.Store(false)
+			return
+		default:
+		}
+		ts.trnt.Piece(i).VerifyData()
+		ts.checked.Add(1)
+	}
+	ts.rechecking.Store(false)
+	os.Remove(ts.path + "/" + RecheckFile)
+	log.Info().
+		Str("Path", ts.path).
+		Int("Complete", ts.trnt.Stats().PiecesComplete).
+		Int("Pieces", ts.trnt.NumPieces()).
+		Str("Took", time.Since(start).Round(time.Second).String()).
+		Msg("Recheck finished")
+}
+
+// Verifies torrents found on start, for -recheck-all. Torrents added later are not touched
+func recheckAll() {
+	TSmu.Lock()
+	defer TSmu.Unlock()
+	for _, ts := range TorrentStorages {
+		go func(ts *TorrentWithStorage) {
+			select {
+			case <-ts.trnt.GotInfo():
+				ts.recheck()
+			case <-ts.trnt.Closed():
+			}
+		}(ts)
+	}
+}
+
+// Called by watcher when `recheck` file is created in torrent dir
+func recheckTorrent(path string) {
+	TSmu.Lock()
+	ts, in := TorrentStorages[path]
+	TSmu.Unlock()
+	if !in {
+		return
+	}
+	if _, err := os.Stat(path + "/" + RecheckFile); err != nil {
+		return
+	}
+	go ts.recheck()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ScheduleRules string
+	Schedule      []*Profile
+	scheduleMu    sync.RWMutex
+	// nil if no profile is active
+	ActiveProfile atomic.Pointer[Profile]
+)
+
+// One rule of schedule:
+//
+//	[name:] [days...] [HH:MM-HH:MM] [download=RATE|off] [upload=RATE|off]
+//
+// Days are `mon`..`sun`, ranges like `mon-fri` or `daily`. Without days the rule works
+// every day, without time - all day long. `off` pauses the traffic for all torrents.
+type Profile struct {
+	Name       string
+	days       [7]bool // Indexed by time.Weekday
+	from, to   int     // Minutes since midnight. If from > to, window crosses midnight
+	limits     Limits
+	download   bool // Limit is set
+	upload     bool
+	noDownload bool
+	noUpload   bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (p *Profile) String() string {
+	if p == nil {
+		return "default"
+	}
+	return p.Name
+}
+
+// Safe to call on nil
+func (p *Profile) NoDownload() bool {
+	return p != nil && p.noDownload
+}
+
+// Safe to call on nil
+func (p *Profile) NoUpload() bool {
+	return p != nil && p.noUpload
+}
+
+func (p *Profile) Apply(limits Limits) Limits {
+	if p.download {
+		limits.Download = p.limits.Download
+	}
+	if p.upload {
+		limits.Upload = p.limits.Upload
+	}
+	return limits
+}
+
+func (p *Profile) Active(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	if p.from <= p.to {
+		return p.days[day] && minute >= p.from && minute < p.to
+	}
+	// Crosses midnight. Days are checked against the start of window
+	if minute >= p.from {
+		return p.days[day]
+	}
+	if minute < p.to {
+		return p.days[(day+6)%7]
+	}
+	return false
+}
+
+func parseProfile(rule string) (*Profile, error) {
+	p := &Profile{
+		Name: rule,
+		from: 0,
+		to:   24 * 60,
+	}
+	fields := strings.Fields(rule)
+	if len(fields) > 0 && strings.HasSuffix(fields[0], ":") && !strings.Contains(fields[0][:len(fields[0])-1], ":") {
+		p.Name = strings.TrimSuffix(fields[0], ":")
+		fields = fields[1:]
+	}
+	hasDays := false
+	for _, field := range fields {
+		key, value, isOption := strings.Cut(field, "=")
+		switch {
+		case isOption:
+			var rate int64
+			off := value == "off"
+			if !off {
+				var err error
+				rate, err = parseRate(value)
+				if err != nil {
+					return nil, fmt.Errorf("%q: %w", field, err)
+				}
+			}
+			switch key {
+			case "download":
+				p.download, p.noDownload, p.limits.Download = true, off, rate
+			case "upload":
+				p.upload, p.noUpload, p.limits.Upload = true, off, rate
+			default:
+				return nil, fmt.Errorf("%q: unknown option, expected download or upload", field)
+			}
+		case strings.Contains(field, ":"):
+			from, to, ok := strings.Cut(field, "-")
+			if !ok {
+				return nil, fmt.Errorf("%q: expected time range HH:MM-HH:MM", field)
+			}
+			var err error
+			if p.from, err = parseMinutes(from); err != nil {
+				return nil, err
+			}
+			if p.to, err = parseMinutes(to); err != nil {
+				return nil, err
+			}
+		case field == "daily":
+			hasDays = true
+			p.days = [7]bool{true, true, true, true, true, true, true}
+		default:
+			from, to, isRange := strings.Cut(field, "-")
+			first, ok1 := weekdays[from]
+			last, ok2 := weekdays[to]
+			if !isRange {
+				last, ok2 = first, ok1
+			}
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("%q: unknown day", field)
+			}
+			hasDays = true
+			for day := first; ; day = (day + 1) % 7 {
+				p.days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+	if !hasDays {
+		p.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return p, nil
+}
+
+func parseMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		// 24:00 is fine for the end of window
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("%q: expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseSchedule(rules string) ([]*Profile, error) {
+	var schedule []*Profile
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		profile, err := parseProfile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", rule, err)
+		}
+		schedule = append(schedule, profile)
+	}
+	return schedule, nil
+}
+
+func loadSchedule() {
+	schedule, err := parseSchedule(ScheduleRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Wrong schedule")
+	}
+	scheduleMu.Lock()
+	Schedule = schedule
+	scheduleMu.Unlock()
+	if len(schedule) > 0 {
+		log.Info().Int("Profiles", len(schedule)).Msg("Schedule loaded")
+	}
+	ActiveProfile.Store(activeProfile(time.Now()))
+}
+
+// First matching profile wins
+func activeProfile(now time.Time) *Profile {
+	scheduleMu.RLock()
+	defer scheduleMu.RUnlock()
+	for _, profile := range Schedule {
+		if profile.Active(now) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// Checks schedule at the beginning of every minute
+func runScheduler() {
+	for {
+		now := time.Now()
+		profile := activeProfile(now)
+		if old := ActiveProfile.Swap(profile); old != profile {
+			log.Info().Str("From", old.String()).Str("To", profile.String()).Msg("Schedule profile changed")
+			applyGlobalLimits()
+			updateAllDataFlow()
+		}
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	everyDay := [7]bool{true, true, true, true, true, true, true}
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	tests := []struct {
+		rule    string
+		want    Profile
+		wantErr bool
+	}{
+		{
+			rule: "night: 01:00-07:00 download=0",
+			want: Profile{Name: "night", days: everyDay, from: 60, to: 420, download: true},
+		},
+		{
+			rule: "mon-fri 09:00-18:00 download=512KB",
+			want: Profile{Name: "mon-fri 09:00-18:00 download=512KB", days: weekdays, from: 540, to: 1080,
+				download: true, limits: Limits{Download: 512 << 10}},
+		},
+		{
+			rule: "weekend: sat-sun upload=off",
+			want: Profile{Name: "weekend", days: [7]bool{true, false, false, false, false, false, true}, to: 1440,
+				upload: true, noUpload: true},
+		},
+		{
+			rule: "late: fri 23:00-24:00",
+			want: Profile{Name: "late", days: [7]bool{5: true}, from: 1380, to: 1440},
+		},
+		{
+			rule: "daily 22:00-02:00 upload=1MB",
+			want: Profile{Name: "daily 22:00-02:00 upload=1MB", days: everyDay, from: 1320, to: 120,
+				upload: true, limits: Limits{Upload: 1 << 20}},
+		},
+		{rule: "someday", wantErr: true},
+		{rule: "mon 25:00-26:00", wantErr: true},
+		{rule: "mon 09:00", wantErr: true},
+		{rule: "ratio=2", wantErr: true},
+		{rule: "download=fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProfile(tt.rule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseProfile(%q) err = %v, wantErr %v", tt.rule, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && *got != tt.want {
+			t.Errorf("parseProfile(%q) = %+v, want %+v", tt.rule, *got, tt.want)
+		}
+	}
+}
+
+func TestProfileActive(t *testing.T) {
+	p, err := parseProfile("fri 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time string
+		want bool
+	}{
+		{"2026-10-16 23:00", true},  // Friday
+		{"2026-10-17 01:30", true},  // Saturday, window started on Friday
+		{"2026-10-17 02:00", false}, // End of window
+		{"2026-10-17 23:00", false}, // Saturday
+		{"2026-10-16 21:59", false},
+	}
+	for _, tt := range tests {
+		now, err := time.Parse("2006-01-02 15:04", tt.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Active(now); got != tt.want {
+			t.Errorf("Active(%s) = %v, want %v", tt.time, got, tt.want)
+		}
+	}
+}
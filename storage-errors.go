@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+const ErrorRetryInterval = time.Minute
+
+// Free space needed to resume torrent after error, if it misses more
+const ResumeSpace = 256 << 20
+
+// Disk errors in mmapped files come as SIGBUS, which kills the process. With
+// debug.SetPanicOnFault they become panics, which are turned into errors there
+//
+//	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+//	defer recoverFault(&err)
+func recoverFault(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if fault, ok := r.(interface{ Addr() uintptr }); ok {
+		*err = fmt.Errorf("memory mapped file fault at %#x, disk may be full", fault.Addr())
+		return
+	}
+	panic(r)
+}
+
+func (ts *TorrentWithStorage) Err() error {
+	ts.errMu.Lock()
+	defer ts.errMu.Unlock()
+	return ts.err
+}
+
+// Pauses torrent until the error is gone. Called by torrent client on failed write
+func (ts *TorrentWithStorage) setError(err error) {
+	storageErrors.Inc()
+	ts.errMu.Lock()
+	if ts.err != nil {
+		ts.errMu.Unlock()
+		return
+	}
+	ts.err = err
+	ts.errMu.Unlock()
+	storageLog.Error().Str("Path", ts.path).Err(err).Msg("Torrent paused by storage error")
+	writeErrorFile(ts.path, err)
+	publishEvent(EventError, ts, map[string]string{"error": err.Error()})
+	runHook("error", ts, err)
+	ts.updateDataFlow()
+	go ts.resumeAfterError()
+}
+
+func (ts *TorrentWithStorage) resumeAfterError() {
+	for {
+		select {
+		case <-ts.trnt.Closed():
+			return
+		case <-time.After(ErrorRetryInterval):
+		}
+		if available, err := freeSpace(ts.path); err == nil && available < min(ts.trnt.BytesMissing(), ResumeSpace) {
+			continue
+		}
+		ts.errMu.Lock()
+		ts.err = nil
+		ts.errMu.Unlock()
+		os.Remove(ts.path + "/" + ErrorFile)
+		ts.updateDataFlow()
+		storageLog.Info().Str("Path", ts.path).Msg("Torrent resumed after error")
+		publishEvent(EventResumed, ts, nil)
+		return
+	}
+}
+
+// Library reports storage errors as text, so the space is checked before torrent is added.
+// Torrents from magnets are checked by storage when info arrives
+func checkStorageSpace(impl storage.ClientImpl, spec *torrent.TorrentSpec, path string) error {
+	mmap, ok := impl.(*mmapClientImpl)
+	if !ok || !mmap.checkSpace || spec.InfoBytes == nil {
+		return nil
+	}
+	var info metainfo.Info
+	if err := bencode.Unmarshal(spec.InfoBytes, &info); err != nil {
+		// Reported by library
+		return nil
+	}
+	return checkFreeSpace(&info, path)
+}
+
+// Torrent which doesn't fit the disk is not added. Try again later
+func retryAddTorrent(path string) {
+	time.Sleep(ErrorRetryInterval)
+	TSmu.Lock()
+	_, in := TorrentStorages[path]
+	TSmu.Unlock()
+	if in || !isTorrentDir(path) {
+		return
+	}
+	AddTorrentFile(path + "/this.torrent")
+}
+
+// Failed write is reported by torrent client, but failed MarkComplete only logged and the
+// piece is downloaded again and again. This storage pauses torrent in that case
+type errorsClientImpl struct {
+	storage.ClientImpl
+	path string
+}
+
+func NewErrorsStorage(impl storage.ClientImpl, path string) storage.ClientImpl {
+	return errorsClientImpl{ClientImpl: impl, path: path}
+}
+
+func (s errorsClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.ClientImpl.OpenTorrent(info, infoHash)
+	if err != nil {
+		return t, err
+	}
+	piece := t.Piece
+	t.Piece = func(p metainfo.Piece) storage.PieceImpl {
+		return errorsPiece{PieceImpl: piece(p), path: s.path}
+	}
+	return t, nil
+}
+
+type errorsPiece struct {
+	storage.PieceImpl
+	path string
+}
+
+func (p errorsPiece) MarkComplete() error {
+	err := p.PieceImpl.MarkComplete()
+	if err != nil {
+		// Torrent client holds its lock there, and TSmu is taken before it elsewhere
+		go func() {
+			TSmu.Lock()
+			ts, in := TorrentStorages[p.path]
+			TSmu.Unlock()
+			if in {
+				ts.setError(err)
+			}
+		}()
+	}
+	return err
+}
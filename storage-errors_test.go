@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func TestCheckStorageSpace(t *testing.T) {
+	dir := t.TempDir()
+	spec := func(length int64) *torrent.TorrentSpec {
+		info := metainfo.Info{Name: "movie.mkv", Length: length, PieceLength: 1 << 20}
+		return &torrent.TorrentSpec{InfoBytes: bencode.MustMarshal(info)}
+	}
+	cache := NewMMapWithCompletion(dir, nil)
+	cache.checkSpace = false
+	tests := []struct {
+		name    string
+		impl    storage.ClientImpl
+		spec    *torrent.TorrentSpec
+		noSpace bool
+	}{
+		{"fits", NewMMapWithCompletion(dir, nil), spec(1 << 20), false},
+		{"too big", NewMMapWithCompletion(dir, nil), spec(1 << 60), true},
+		{"not checked", cache, spec(1 << 60), false},
+		{"magnet", NewMMapWithCompletion(dir, nil), &torrent.TorrentSpec{}, false},
+		{"other storage", NewMemoryStorage(), spec(1 << 60), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStorageSpace(tt.impl, tt.spec, dir)
+			if errors.Is(err, ErrNoSpace) != tt.noSpace {
+				t.Errorf("err = %v, want ErrNoSpace %v", err, tt.noSpace)
+			}
+			if !tt.noSpace && err != nil {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
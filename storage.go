@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Name of file with storage type for torrents in this dir and all subdirs
+const StorageFile = "storage.txt"
+
+var (
+	StorageType string
+	Allocation  string
+	cacheOnce   sync.Once
+
+	ErrNoSpace = errors.New("not enough disk space")
+)
+
+// Data of these storages is not in regular files of torrent dir, or can disappear from them
+var streamOnlyStorages = map[string]bool{
+	"cache":  true,
+	"bolt":   true,
+	"memory": true,
+}
+
+// Only what is read is downloaded. Evicted pieces of cache must not come back in background,
+// and memory would hold the whole torrent in RAM
+var onDemandStorages = map[string]bool{
+	"cache":  true,
+	"memory": true,
+}
+
+func checkStorageType(kind string) error {
+	switch kind {
+	case "mmap", "file", "bolt", "memory", "cache":
+		return nil
+	}
+	return fmt.Errorf("unknown storage %q, expected mmap, file, bolt, memory or cache", kind)
+}
+
+func initStorage() {
+	if err := checkStorageType(StorageType); err != nil {
+		storageLog.Fatal().Err(err).Msg("Wrong storage")
+	}
+	switch Allocation {
+	case AllocSparse, AllocFull, AllocFirstWrite:
+	default:
+		storageLog.Fatal().Str("Allocation", Allocation).Msg("Unknown allocation, expected sparse, full or first-write")
+	}
+	size, err := parseSize(CacheSize)
+	if err != nil || size <= 0 {
+		storageLog.Fatal().Str("Value", CacheSize).Err(err).Msg("Wrong cache size")
+	}
+}
+
+// Shared by all torrents with cache storage
+func getCache() *PieceCache {
+	cacheOnce.Do(func() {
+		size, _ := parseSize(CacheSize)
+		Cache = NewPieceCache(size)
+		storageLog.Info().Str("Size", CacheSize).Msg("Using cache storage")
+	})
+	return Cache
+}
+
+// Storage type from the nearest `storage.txt` up to TorrentsDir, or -storage flag
+func storageType(path string) string {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		buf, err := os.ReadFile(dir + "/" + StorageFile)
+		if err == nil {
+			kind := strings.TrimSpace(string(buf))
+			if err := checkStorageType(kind); err != nil {
+				storageLog.Error().Str("Path", dir+"/"+StorageFile).Err(err).Msg("Wrong storage, using default")
+				break
+			}
+			return kind
+		}
+		if dir == TorrentsDir || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return StorageType
+}
+
+// Storage for torrent in dir `path`. All of them keep torrent files right in `path`,
+// without a folder named after the torrent
+func newStorage(path string, kind string) (storage.ClientImpl, error) {
+	switch kind {
+	case "file":
+		return storage.NewFileOpts(storage.NewFileClientOpts{
+			ClientBaseDir:   path,
+			FilePathMaker:   filePathMaker,
+			PieceCompletion: PieceCompletion,
+		}), nil
+	case "bolt":
+		db, err := newBoltDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return closingClientImpl{db}, nil
+	case "memory":
+		return NewMemoryStorage(), nil
+	case "cache":
+		mmap := NewMMapWithCompletion(path, PieceCompletion)
+		// Only cached pieces take space
+		mmap.allocation = AllocSparse
+		mmap.checkSpace = false
+		return NewCacheStorage(mmap, getCache()), nil
+	}
+	return NewMMapWithCompletion(path, PieceCompletion), nil
+}
+
+// Same layout as in mmap storage
+func filePathMaker(opts storage.FilePathMakerOpts) string {
+	if len(opts.File.Path) == 0 {
+		return opts.Info.Name
+	}
+	return filepath.Join(opts.File.Path...)
+}
+
+// Library panics if db can't be opened
+func newBoltDB(path string) (db storage.ClientImplCloser, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("can't open bolt db: %v", r)
+		}
+	}()
+	return storage.NewBoltDB(path), nil
+}
+
+// Closes the whole storage with the torrent. Only for storages not shared with others
+type closingClientImpl struct {
+	storage.ClientImplCloser
+}
+
+func (s closingClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.ClientImplCloser.OpenTorrent(info, infoHash)
+	if err != nil {
+		return t, err
+	}
+	closeTorrent := t.Close
+	t.Close = func() error {
+		err := closeTorrent()
+		if closeErr := s.ClientImplCloser.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return t, nil
+}
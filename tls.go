@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// Self-signed certificate is kept in own dir inside metadata dir. The dir is watched, and
+// the metadata dir has the piece completion database, changed all the time
+const (
+	SelfSignedDir      = "tls"
+	SelfSignedCertFile = "tls-cert.pem"
+	SelfSignedKeyFile  = "tls-key.pem"
+)
+
+var (
+	TLSCert       string
+	TLSKey        string
+	TLSSelfSigned bool
+	TLSRedirect   string // Address of plain HTTP listener redirecting to HTTPS
+
+	certificate atomic.Pointer[tls.Certificate]
+	// Dirs watched only for certificates, outside of TorrentsDir
+	certDirs = make(map[string]bool)
+)
+
+func tlsEnabled() bool {
+	return TLSCert != "" || TLSSelfSigned
+}
+
+// Loads certificate and watches its files. Must be called after initWatcher
+func initTLS() {
+	if !tlsEnabled() {
+		if TLSRedirect != "" {
+			log.Fatal().Msg("-tls-redirect requires -tls-cert or -tls-self-signed")
+		}
+		return
+	}
+	if TLSCert == "" || TLSKey == "" {
+		if TLSCert != "" || TLSKey != "" {
+			log.Fatal().Msg("Both -tls-cert and -tls-key are required")
+		}
+		dir := filepath.Join(MetaDataDir, SelfSignedDir)
+		ensureDirExists(dir)
+		TLSCert = filepath.Join(dir, SelfSignedCertFile)
+		TLSKey = filepath.Join(dir, SelfSignedKeyFile)
+		if _, err := os.Stat(TLSCert); os.IsNotExist(err) {
+			if err := generateCertificate(TLSCert, TLSKey); err != nil {
+				log.Fatal().Str("Path", TLSCert).Err(err).Msg("Can't generate self-signed certificate")
+			}
+			log.Info().Str("Path", TLSCert).Msg("Self-signed certificate generated")
+		}
+	}
+	TLSCert = filepath.Clean(TLSCert)
+	TLSKey = filepath.Clean(TLSKey)
+	if err := loadCertificate(); err != nil {
+		log.Fatal().Str("Cert", TLSCert).Str("Key", TLSKey).Err(err).Msg("Can't load certificate")
+	}
+
+	torrentsDir, _ := filepath.Abs(TorrentsDir)
+	for _, path := range []string{TLSCert, TLSKey} {
+		dir := filepath.Dir(path)
+		if abs, _ := filepath.Abs(dir); abs == torrentsDir || strings.HasPrefix(abs, torrentsDir+string(filepath.Separator)) {
+			continue
+		}
+		if err := Watcher.Add(dir); err != nil {
+			log.Error().Str("Path", dir).Err(err).Msg("Can't watch certificate dir")
+			continue
+		}
+		certDirs[dir] = true
+	}
+}
+
+func loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(TLSCert, TLSKey)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	certificate.Store(&cert)
+	log.Info().
+		Str("Path", TLSCert).
+		Strs("Names", cert.Leaf.DNSNames).
+		Time("Expires", cert.Leaf.NotAfter).
+		Msg("Certificate loaded")
+	return nil
+}
+
+// Called by watcher. Returns true if event is not about torrents
+func handleCertEvent(event fsnotify.Event) bool {
+	if !tlsEnabled() {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	if name == TLSCert || name == TLSKey {
+		if event.Has(fsnotify.Remove) {
+			return true
+		}
+		// Certificate and key can be replaced one by one, previous one is used until both match
+		if err := loadCertificate(); err != nil {
+			log.Warn().Str("Path", name).Err(err).Msg("Can't reload certificate")
+		}
+		return true
+	}
+	return certDirs[filepath.Dir(name)]
+}
+
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certificate.Load(), nil
+		},
+	}
+}
+
+// Redirects plain HTTP requests to the same path of HTTPS server. Started by runRedirect
+func newRedirect(addr string) *http.Server {
+	_, port, err := net.SplitHostPort(WebDavAddr)
+	if err != nil {
+		log.Fatal().Str("Addr", WebDavAddr).Err(err).Msg("Wrong listen address")
+	}
+	return &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			} else {
+				// IPv6 without port, `[::1]`
+				host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			}
+			if port != "443" {
+				host = net.JoinHostPort(host, port)
+			} else if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+			// 308 keeps method and body, which matters for WebDav
+			http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect)
+		}),
+	}
+}
+
+func runRedirect(srv *http.Server) {
+	log.Info().Str("addr", "http://"+srv.Addr).Msg("HTTPS redirect started")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal().Str("Addr", srv.Addr).Err(err).Msg("HTTPS redirect")
+	}
+}
+
+// ECDSA certificate for localhost, host name and addresses of this machine
+func generateCertificate(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"trnt2webdav"}, CommonName: "trnt2webdav"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(WebDavAddr); err == nil && host != "" && net.ParseIP(host) == nil {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return errors.Join(err, os.Remove(keyPath))
+	}
+	return nil
+}
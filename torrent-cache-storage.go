@@ -0,0 +1,207 @@
+// Storage with limited size on top of the mmap one. Keeps recently used pieces of all
+// torrents, the least recently used are evicted: marked not complete and removed from
+// disk, so they are downloaded again when needed
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+var (
+	CacheSize string
+	Cache     *PieceCache
+)
+
+type PieceCache struct {
+	mu      sync.Mutex
+	budget  int64
+	used    int64
+	lru     *list.List // Of *cacheEntry, front is the most recent
+	entries map[metainfo.PieceKey]*list.Element
+}
+
+type cacheEntry struct {
+	key     metainfo.PieceKey
+	p       metainfo.Piece
+	piece   storage.PieceImpl // Of mmap storage
+	storage *mmapTorrentStorage
+}
+
+func NewPieceCache(budget int64) *PieceCache {
+	return &PieceCache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: make(map[metainfo.PieceKey]*list.Element),
+	}
+}
+
+// Returns used and total bytes
+func (c *PieceCache) Usage() (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used, c.budget
+}
+
+func (c *PieceCache) touch(key metainfo.PieceKey) {
+	c.mu.Lock()
+	if e, in := c.entries[key]; in {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+}
+
+// Old entries are added to the back, as the first candidates for eviction. They are not
+// evicted until trim: evicted pieces are forgotten by the torrent only if it's in the client
+func (c *PieceCache) add(entry *cacheEntry, old bool) {
+	c.mu.Lock()
+	if e, in := c.entries[entry.key]; in {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return
+	}
+	if old {
+		c.entries[entry.key] = c.lru.PushBack(entry)
+	} else {
+		c.entries[entry.key] = c.lru.PushFront(entry)
+	}
+	c.used += entry.p.Length()
+	c.mu.Unlock()
+	if !old {
+		c.trim()
+	}
+}
+
+// Evicts the least recently used pieces while the cache is over budget
+func (c *PieceCache) trim() {
+	c.mu.Lock()
+	var evicted []*cacheEntry
+	// The newest piece stays even if it doesn't fit
+	for c.used > c.budget && c.lru.Len() > 1 {
+		e := c.lru.Back()
+		victim := e.Value.(*cacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, victim.key)
+		c.used -= victim.p.Length()
+		evicted = append(evicted, victim)
+	}
+	c.mu.Unlock()
+	if len(evicted) > 0 {
+		// Torrent client can hold its lock there
+		go c.evict(evicted)
+	}
+}
+
+func (c *PieceCache) remove(key metainfo.PieceKey) {
+	c.mu.Lock()
+	if e, in := c.entries[key]; in {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		c.used -= e.Value.(*cacheEntry).p.Length()
+	}
+	c.mu.Unlock()
+}
+
+// Called when torrent storage is closed. Data stays on disk
+func (c *PieceCache) forget(infoHash metainfo.Hash) {
+	c.mu.Lock()
+	for key, e := range c.entries {
+		if key.InfoHash == infoHash {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+			c.used -= e.Value.(*cacheEntry).p.Length()
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *PieceCache) evict(entries []*cacheEntry) {
+	for _, e := range entries {
+		if err := e.piece.MarkNotComplete(); err != nil {
+			storageLog.Error().Err(err).Str("Piece", e.p.Hash().HexString()).Msg("Can't evict piece")
+			continue
+		}
+		// Torrent keeps own copy of piece states
+		if trnt, ok := TorrentClient.Torrent(e.key.InfoHash); ok {
+			trnt.Piece(e.key.Index).UpdateCompletion()
+		}
+		err := e.storage.Discard(e.p.Offset(), e.p.Length())
+		if errors.Is(err, errors.ErrUnsupported) {
+			storageLog.Debug().Msg("Freeing disk space is not supported on this system")
+		} else if err != nil {
+			storageLog.Error().Err(err).Str("InfoHash", e.key.InfoHash.HexString()).Msg("Can't free evicted piece")
+		}
+	}
+	storageLog.Debug().Int("Pieces", len(entries)).Msg("Evicted from cache")
+}
+
+/////////////////////////////////////////////////////////////////////////////////
+
+type cacheClientImpl struct {
+	mmap  *mmapClientImpl
+	cache *PieceCache
+}
+
+func NewCacheStorage(mmap *mmapClientImpl, cache *PieceCache) storage.ClientImpl {
+	return cacheClientImpl{mmap: mmap, cache: cache}
+}
+
+func (s cacheClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := s.mmap.open(info, infoHash)
+	if err != nil {
+		return storage.TorrentImpl{Close: t.Close}, err
+	}
+	newEntry := func(p metainfo.Piece) *cacheEntry {
+		return &cacheEntry{
+			key:     metainfo.PieceKey{InfoHash: infoHash, Index: p.Index()},
+			p:       p,
+			piece:   t.Piece(p),
+			storage: t,
+		}
+	}
+	// Downloaded before
+	for i := 0; i < info.NumPieces(); i++ {
+		entry := newEntry(info.Piece(i))
+		if entry.piece.Completion().Complete {
+			s.cache.add(entry, true)
+		}
+	}
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return cachePiece{PieceImpl: t.Piece(p), entry: newEntry(p), cache: s.cache}
+		},
+		Close: func() error {
+			s.cache.forget(infoHash)
+			return t.Close()
+		},
+		Flush: t.Flush,
+	}, nil
+}
+
+type cachePiece struct {
+	storage.PieceImpl
+	entry *cacheEntry
+	cache *PieceCache
+}
+
+func (p cachePiece) ReadAt(b []byte, off int64) (int, error) {
+	p.cache.touch(p.entry.key)
+	return p.PieceImpl.ReadAt(b, off)
+}
+
+func (p cachePiece) MarkComplete() error {
+	err := p.PieceImpl.MarkComplete()
+	if err == nil {
+		p.cache.add(p.entry, false)
+	}
+	return err
+}
+
+func (p cachePiece) MarkNotComplete() error {
+	p.cache.remove(p.entry.key)
+	return p.PieceImpl.MarkNotComplete()
+}
@@ -0,0 +1,8 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// Punches a hole in the file behind the mapped region
+func discardRegion(b []byte) error {
+	return unix.Madvise(b, unix.MADV_REMOVE)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func discardRegion(b []byte) error {
+	return errors.ErrUnsupported
+}
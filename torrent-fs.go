@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -10,14 +11,17 @@ import (
 	"time"
 
 	"github.com/anacrolix/torrent"
-	"github.com/rs/zerolog/log"
 	"golang.org/x/net/webdav"
 )
 
+var errShuttingDown = errors.New("server is shutting down")
+
 type TFS struct {
 	torrent *torrent.Torrent
 	list    map[string]*TFS_File
 	root    *TFS_File
+	// Data is not in regular files, or pieces can be evicted from them at any time
+	streamOnly bool
 }
 
 type TFS_File struct {
@@ -36,6 +40,55 @@ type TFS_FileHandler struct {
 	closed    bool
 }
 
+// Handlers streaming from torrents, waited for on shutdown
+var openReaders = readerCounter{idle: make(chan struct{})}
+
+// Unlike sync.WaitGroup allows new readers while waiting: they are refused
+type readerCounter struct {
+	mu      sync.Mutex
+	count   int
+	closing bool
+	idle    chan struct{} // Closed when the last reader is done while closing
+}
+
+// Returns false on shutdown
+func (c *readerCounter) add() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return false
+	}
+	c.count++
+	return true
+}
+
+func (c *readerCounter) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count--
+	if c.closing && c.count == 0 {
+		close(c.idle)
+	}
+}
+
+// Returns false if some readers are still open when ctx is done
+func waitReaders(ctx context.Context) bool {
+	c := &openReaders
+	c.mu.Lock()
+	c.closing = true
+	count := c.count
+	c.mu.Unlock()
+	if count == 0 {
+		return true
+	}
+	select {
+	case <-c.idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func NewTFS(torrent *torrent.Torrent) *TFS {
 	tfs := &TFS{}
 	tfs.torrent = torrent
@@ -51,7 +104,7 @@ func NewTFS(torrent *torrent.Torrent) *TFS {
 	for _, f := range torrent.Files() {
 		// Try find all parents dirs, add if not exists
 		// dir1/dir2/dir3/file   ->   dir1,  dir1/dir2,  dir1/dir2/dir3
-		log.Debug().Str("file", f.DisplayPath()).Msg("TFS")
+		webdavLog.Debug().Str("file", f.DisplayPath()).Msg("TFS")
 		parts := strings.Split(f.DisplayPath(), "/")
 		parentDir := tfs.root
 		path := ""
@@ -94,11 +147,14 @@ func (tfs TFS) IsFileCompleted(name string) bool {
 	if entry.mode.IsDir() {
 		return true
 	}
+	// Always read through the torrent, so it notices evicted pieces
+	if tfs.streamOnly {
+		return false
+	}
 	len := entry.t_file.Length()
 	bc := entry.t_file.BytesCompleted()
 	if bc > len {
-		println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
-		log.Warn().Int64("Length", len).Int64("BytesCompleted", bc).Msg("WTF TODO") //TODO
+		webdavLog.Warn().Int64("Length", len).Int64("BytesCompleted", bc).Msg("WTF TODO") //TODO
 	}
 	return bc >= len
 }
@@ -147,6 +203,23 @@ func (f *TFS_File) ModTime() time.Time { return f.modTime }
 func (f *TFS_File) IsDir() bool        { return f.mode.IsDir() }
 func (f *TFS_File) Sys() interface{}   { return nil }
 
+// Reader raises priority of pieces around the read position, so in on-demand mode
+// only the read parts are downloaded. Must be called with f.mu locked.
+func (f *TFS_FileHandler) openReader() error {
+	if f.reader != nil {
+		return nil
+	}
+	if !openReaders.add() {
+		return errShuttingDown
+	}
+	f.reader = f.fileOrDir.t_file.NewReader()
+	activeReaders.Inc()
+	if ReadaheadBytes > 0 {
+		f.reader.SetReadahead(ReadaheadBytes)
+	}
+	return nil
+}
+
 ////////// WebDav.File interface
 
 // io.Writer
@@ -163,6 +236,8 @@ func (f *TFS_FileHandler) Close() error {
 	}
 	if f.reader != nil {
 		f.reader.Close()
+		activeReaders.Dec()
+		openReaders.done()
 		f.closed = true
 	}
 	return nil
@@ -179,8 +254,8 @@ func (f *TFS_FileHandler) Read(p []byte) (n int, err error) {
 	if f.closed {
 		return 0, os.ErrClosed
 	}
-	if f.reader == nil {
-		f.reader = f.fileOrDir.t_file.NewReader()
+	if err := f.openReader(); err != nil {
+		return 0, err
 	}
 	return f.reader.Read(p)
 }
@@ -196,8 +271,8 @@ func (f *TFS_FileHandler) Seek(offset int64, whence int) (int64, error) {
 	if f.closed {
 		return 0, os.ErrClosed
 	}
-	if f.reader == nil {
-		f.reader = f.fileOrDir.t_file.NewReader()
+	if err := f.openReader(); err != nil {
+		return 0, err
 	}
 	return f.reader.Seek(offset, whence)
 }
@@ -0,0 +1,120 @@
+// Keeps torrent data in RAM. Nothing survives restart, so completion is not stored
+// in the shared PieceCompletion
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+type memoryClientImpl struct{}
+
+func NewMemoryStorage() storage.ClientImpl {
+	return memoryClientImpl{}
+}
+
+func (memoryClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t := &memoryTorrentStorage{
+		pieces: make([]memoryPiece, info.NumPieces()),
+	}
+	return storage.TorrentImpl{Piece: t.Piece, Close: t.Close}, nil
+}
+
+type memoryTorrentStorage struct {
+	mu     sync.RWMutex
+	pieces []memoryPiece
+}
+
+type memoryPiece struct {
+	data     []byte // Allocated on first write
+	complete bool
+}
+
+func (ts *memoryTorrentStorage) Piece(p metainfo.Piece) storage.PieceImpl {
+	return memoryStoragePiece{ts: ts, p: p}
+}
+
+func (ts *memoryTorrentStorage) Close() error {
+	ts.mu.Lock()
+	ts.pieces = nil
+	ts.mu.Unlock()
+	return nil
+}
+
+type memoryStoragePiece struct {
+	ts *memoryTorrentStorage
+	p  metainfo.Piece
+}
+
+func (sp memoryStoragePiece) ReadAt(b []byte, off int64) (n int, err error) {
+	sp.ts.mu.RLock()
+	defer sp.ts.mu.RUnlock()
+	if sp.ts.pieces == nil {
+		return 0, io.ErrClosedPipe
+	}
+	data := sp.ts.pieces[sp.p.Index()].data
+	if off >= sp.p.Length() {
+		return 0, io.EOF
+	}
+	if data == nil {
+		// Not written yet
+		n = int(min(int64(len(b)), sp.p.Length()-off))
+		clear(b[:n])
+	} else {
+		n = copy(b, data[off:])
+	}
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (sp memoryStoragePiece) WriteAt(b []byte, off int64) (n int, err error) {
+	sp.ts.mu.Lock()
+	defer sp.ts.mu.Unlock()
+	if sp.ts.pieces == nil {
+		return 0, io.ErrClosedPipe
+	}
+	piece := &sp.ts.pieces[sp.p.Index()]
+	if piece.data == nil {
+		piece.data = make([]byte, sp.p.Length())
+	}
+	if off >= int64(len(piece.data)) {
+		return 0, io.ErrShortWrite
+	}
+	n = copy(piece.data[off:], b)
+	if n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+func (sp memoryStoragePiece) MarkComplete() error {
+	sp.ts.mu.Lock()
+	defer sp.ts.mu.Unlock()
+	if sp.ts.pieces != nil {
+		sp.ts.pieces[sp.p.Index()].complete = true
+	}
+	return nil
+}
+
+func (sp memoryStoragePiece) MarkNotComplete() error {
+	sp.ts.mu.Lock()
+	defer sp.ts.mu.Unlock()
+	if sp.ts.pieces != nil {
+		sp.ts.pieces[sp.p.Index()].complete = false
+	}
+	return nil
+}
+
+func (sp memoryStoragePiece) Completion() storage.Completion {
+	sp.ts.mu.RLock()
+	defer sp.ts.mu.RUnlock()
+	if sp.ts.pieces == nil {
+		return storage.Completion{}
+	}
+	return storage.Completion{Complete: sp.ts.pieces[sp.p.Index()].complete, Ok: true}
+}
@@ -9,18 +9,30 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sync"
 
 	"github.com/anacrolix/missinggo/v2"
 	"github.com/edsrzf/mmap-go"
+	"github.com/inhies/go-bytesize"
 
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/mmap_span"
 	"github.com/anacrolix/torrent/storage"
 )
 
+// How disk space for torrent files is allocated
+const (
+	AllocSparse     = "sparse"      // Files are truncated to full size, space is taken while writing
+	AllocFull       = "full"        // All space is reserved when torrent is added
+	AllocFirstWrite = "first-write" // Space for a file is reserved on the first write into it
+)
+
 type mmapClientImpl struct {
-	baseDir string
-	pc      storage.PieceCompletion
+	baseDir    string
+	pc         storage.PieceCompletion
+	allocation string
+	checkSpace bool // Refuse to open torrent which doesn't fit the disk
 }
 
 // // TODO: Support all the same native filepath configuration that NewFileOpts provides.
@@ -30,33 +42,108 @@ type mmapClientImpl struct {
 
 func NewMMapWithCompletion(baseDir string, completion storage.PieceCompletion) *mmapClientImpl {
 	return &mmapClientImpl{
-		baseDir: baseDir,
-		pc:      completion,
+		baseDir:    baseDir,
+		pc:         completion,
+		allocation: Allocation,
+		checkSpace: true,
 	}
 }
 
 func (s *mmapClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (_ storage.TorrentImpl, err error) {
-	span, err := mMapTorrent(info, s.baseDir)
+	t, err := s.open(info, infoHash)
+	return storage.TorrentImpl{Piece: t.Piece, Close: t.Close, Flush: t.Flush}, err
+}
+
+func (s *mmapClientImpl) open(info *metainfo.Info, infoHash metainfo.Hash) (*mmapTorrentStorage, error) {
 	t := &mmapTorrentStorage{
 		infoHash: infoHash,
-		span:     span,
+		span:     &mmap_span.MMapSpan{},
 		pc:       s.pc,
 	}
-	return storage.TorrentImpl{Piece: t.Piece, Close: t.Close, Flush: t.Flush}, err
+	if s.checkSpace {
+		if err := checkFreeSpace(info, s.baseDir); err != nil {
+			return t, err
+		}
+	}
+	span, mappings, err := mMapTorrent(info, s.baseDir, s.allocation == AllocFull)
+	t.span = span
+	t.mappings = mappings
+	if s.allocation == AllocFirstWrite {
+		t.allocated = make([]bool, len(mappings))
+	}
+	if err == nil {
+		mmapStoragesMu.Lock()
+		mmapStorages[t] = true
+		mmapStoragesMu.Unlock()
+	}
+	return t, err
+}
+
+// Compares free space with what is not yet allocated for torrent files
+func checkFreeSpace(info *metainfo.Info, location string) error {
+	var need int64
+	for _, miFile := range info.UpvertedFiles() {
+		fileName, err := mmapFilePath(info, miFile, location)
+		if err != nil {
+			return err
+		}
+		allocated, err := allocatedSize(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		need += max(miFile.Length-allocated, 0)
+	}
+	available, err := freeSpace(location)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if need > available {
+		return fmt.Errorf("%w: need %s, available %s", ErrNoSpace,
+			bytesize.New(float64(need)), bytesize.New(float64(available)))
+	}
+	return nil
 }
 
 func (s *mmapClientImpl) Close() error {
 	return s.pc.Close()
 }
 
+// Opened torrents, flushed on shutdown
+var (
+	mmapStorages   = make(map[*mmapTorrentStorage]bool)
+	mmapStoragesMu sync.Mutex
+)
+
+// Writes changed pages of all opened torrents to disk
+func flushMMapStorages() {
+	mmapStoragesMu.Lock()
+	list := make([]*mmapTorrentStorage, 0, len(mmapStorages))
+	for ts := range mmapStorages {
+		list = append(list, ts)
+	}
+	mmapStoragesMu.Unlock()
+	for _, ts := range list {
+		if err := ts.Flush(); err != nil {
+			storageLog.Error().Str("InfoHash", ts.infoHash.HexString()).Err(err).Msg("Can't flush storage")
+		}
+	}
+}
+
 type mmapTorrentStorage struct {
-	infoHash metainfo.Hash
-	span     *mmap_span.MMapSpan
-	pc       storage.PieceCompletionGetSetter
+	infoHash  metainfo.Hash
+	span      *mmap_span.MMapSpan
+	mappings  []FileMapping // Same as in span, which doesn't expose them
+	allocated []bool        // For AllocFirstWrite, per mapping
+	mu        sync.RWMutex  // For mappings and allocated
+	pc        storage.PieceCompletionGetSetter
 }
 
 func (ts *mmapTorrentStorage) Piece(p metainfo.Piece) storage.PieceImpl {
 	return mmapStoragePiece{
+		ts:       ts,
 		pc:       ts.pc,
 		p:        p,
 		ih:       ts.infoHash,
@@ -66,6 +153,12 @@ func (ts *mmapTorrentStorage) Piece(p metainfo.Piece) storage.PieceImpl {
 }
 
 func (ts *mmapTorrentStorage) Close() error {
+	mmapStoragesMu.Lock()
+	delete(mmapStorages, ts)
+	mmapStoragesMu.Unlock()
+	ts.mu.Lock()
+	ts.mappings = nil
+	ts.mu.Unlock()
 	errs := ts.span.Close()
 	if len(errs) > 0 {
 		return errs[0]
@@ -81,7 +174,86 @@ func (ts *mmapTorrentStorage) Flush() error {
 	return nil
 }
 
+// Reserves disk space for files in range [off, off+n) which were not written before
+func (ts *mmapTorrentStorage) allocate(off, n int64) error {
+	if ts.allocated == nil {
+		return nil
+	}
+	// Called on every write, mostly for allocated files
+	ts.mu.RLock()
+	done := true
+	ts.forFiles(off, n, func(i int, m FileMapping) error {
+		done = done && ts.allocated[i]
+		return nil
+	})
+	ts.mu.RUnlock()
+	if done {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.forFiles(off, n, func(i int, m FileMapping) error {
+		if ts.allocated[i] {
+			return nil
+		}
+		err := allocateFile(m.(mmapWithFile).f, int64(len(m.Bytes())))
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+		ts.allocated[i] = true
+		return nil
+	})
+}
+
+// Calls f for mappings of files in range [off, off+n). Must be called with ts.mu locked
+func (ts *mmapTorrentStorage) forFiles(off, n int64, f func(i int, m FileMapping) error) error {
+	var fileOff int64
+	for i, m := range ts.mappings {
+		fileEnd := fileOff + int64(len(m.Bytes()))
+		overlaps := off < fileEnd && off+n > fileOff
+		fileOff = fileEnd
+		if !overlaps {
+			continue
+		}
+		if err := f(i, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Frees disk space of the torrent data in range [off, off+n). The range reads as zeros after
+func (ts *mmapTorrentStorage) Discard(off, n int64) error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	var fileOff int64
+	for _, m := range ts.mappings {
+		b := m.Bytes()
+		fileEnd := fileOff + int64(len(b))
+		start := max(off, fileOff) - fileOff
+		end := min(off+n, fileEnd) - fileOff
+		fileOff = fileEnd
+		if start >= end {
+			continue
+		}
+		// Only whole pages can be freed
+		pageSize := int64(os.Getpagesize())
+		start = (start + pageSize - 1) / pageSize * pageSize
+		if end != int64(len(b)) {
+			end = end / pageSize * pageSize
+		}
+		if start >= end {
+			continue
+		}
+		if err := discardRegion(b[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type mmapStoragePiece struct {
+	ts *mmapTorrentStorage
 	pc storage.PieceCompletionGetSetter
 	p  metainfo.Piece
 	ih metainfo.Hash
@@ -90,28 +262,58 @@ type mmapStoragePiece struct {
 }
 
 func (me mmapStoragePiece) pieceKey() metainfo.PieceKey {
-	return metainfo.PieceKey{me.ih, me.p.Index()}
+	return metainfo.PieceKey{InfoHash: me.ih, Index: me.p.Index()}
+}
+
+func (sp mmapStoragePiece) WriteAt(b []byte, off int64) (n int, err error) {
+	if err = sp.ts.allocate(sp.p.Offset()+off, int64(len(b))); err != nil {
+		return
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err)
+	return sp.WriterAt.WriteAt(b, off)
+}
+
+func (sp mmapStoragePiece) ReadAt(b []byte, off int64) (n int, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err)
+	return sp.ReaderAt.ReadAt(b, off)
 }
 
 func (sp mmapStoragePiece) Completion() storage.Completion {
 	c, err := sp.pc.Get(sp.pieceKey())
 	if err != nil {
-		panic(err)
+		// Piece will be checked
+		return storage.Completion{Err: err}
 	}
 	return c
 }
 
 func (sp mmapStoragePiece) MarkComplete() error {
-	sp.pc.Set(sp.pieceKey(), true)
-	return nil
+	return sp.pc.Set(sp.pieceKey(), true)
 }
 
 func (sp mmapStoragePiece) MarkNotComplete() error {
-	sp.pc.Set(sp.pieceKey(), false)
-	return nil
+	return sp.pc.Set(sp.pieceKey(), false)
 }
 
-func mMapTorrent(md *metainfo.Info, location string) (mms *mmap_span.MMapSpan, err error) {
+func mmapFilePath(md *metainfo.Info, miFile metainfo.FileInfo, location string) (string, error) {
+	var safeName string
+	var err error
+	// safeName, err = storage.ToSafeFilePath(append([]string{md.Name}, miFile.Path...)...)
+	// Jipok:
+	if miFile.Path == nil {
+		safeName, err = storage.ToSafeFilePath(md.Name)
+	} else {
+		safeName, err = storage.ToSafeFilePath(miFile.Path...)
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(location, safeName), nil
+}
+
+func mMapTorrent(md *metainfo.Info, location string, preallocate bool) (mms *mmap_span.MMapSpan, mappings []FileMapping, err error) {
 	mms = &mmap_span.MMapSpan{}
 	defer func() {
 		if err != nil {
@@ -119,31 +321,25 @@ func mMapTorrent(md *metainfo.Info, location string) (mms *mmap_span.MMapSpan, e
 		}
 	}()
 	for _, miFile := range md.UpvertedFiles() {
-		var safeName string
-		// safeName, err = storage.ToSafeFilePath(append([]string{md.Name}, miFile.Path...)...)
-		// Jipok:
-		if miFile.Path == nil {
-			safeName, err = storage.ToSafeFilePath(md.Name)
-		} else {
-			safeName, err = storage.ToSafeFilePath(miFile.Path...)
-		}
+		var fileName string
+		fileName, err = mmapFilePath(md, miFile, location)
 		if err != nil {
 			return
 		}
-		fileName := filepath.Join(location, safeName)
 		var mm FileMapping
-		mm, err = mmapFile(fileName, miFile.Length)
+		mm, err = mmapFile(fileName, miFile.Length, preallocate)
 		if err != nil {
 			err = fmt.Errorf("file %q: %s", miFile.DisplayPath(md), err)
 			return
 		}
 		mms.Append(mm)
+		mappings = append(mappings, mm)
 	}
 	mms.InitIndex()
 	return
 }
 
-func mmapFile(name string, size int64) (_ FileMapping, err error) {
+func mmapFile(name string, size int64, preallocate bool) (_ FileMapping, err error) {
 	dir := filepath.Dir(name)
 	err = os.MkdirAll(dir, 0o750)
 	if err != nil {
@@ -165,6 +361,13 @@ func mmapFile(name string, size int64) (_ FileMapping, err error) {
 	if err != nil {
 		return
 	}
+	if preallocate {
+		err = allocateFile(file, size)
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return
+		}
+		err = nil
+	}
 	if fi.Size() < size {
 		// I think this is necessary on HFS+. Maybe Linux will SIGBUS too if
 		// you overmap a file but I'm not sure.
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reserves disk space, so writes into the mapped file can't fail with SIGBUS
+func allocateFile(file *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	return unix.Fallocate(int(file.Fd()), 0, 0, size)
+}
+
+// Space really taken by the file, less than its size for sparse files
+func allocatedSize(name string) (int64, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512, nil
+}
+
+func freeSpace(dir string) (int64, error) {
+	// Torrent dir can be not created yet
+	for {
+		var stat unix.Statfs_t
+		err := unix.Statfs(dir, &stat)
+		if err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), nil
+		}
+		if !os.IsNotExist(err) || dir == "/" || dir == "." {
+			return 0, err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
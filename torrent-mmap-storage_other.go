@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func allocateFile(file *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
+
+func allocatedSize(name string) (int64, error) {
+	_, err := os.Stat(name)
+	return 0, err
+}
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
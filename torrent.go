@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	torrent_log "github.com/anacrolix/log"
@@ -13,41 +16,209 @@ import (
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/storage"
 	"github.com/inhies/go-bytesize"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+const PausedFile = "paused"
+
+// Reason why torrent can't work, e.g. not enough disk space
+const ErrorFile = "error.txt"
+
 type TorrentWithStorage struct {
+	path    string
 	trnt    *torrent.Torrent
 	storage *storage.ClientImpl
+	limits  *TorrentLimits
+	paused  atomic.Bool // `paused` file exists in torrent dir
+	kind    string      // Storage type
+	// Download only what is read
+	onDemand bool
+	err      error // Storage error, torrent is paused until it's gone
+	errMu    sync.Mutex
+	// Verifying data, `checked` pieces of all are done
+	rechecking atomic.Bool
+	checked    atomic.Int64
+	// Bytes per second, updated by measureRates
+	downloadRate atomic.Int64
+	uploadRate   atomic.Int64
+}
+
+// One of: metadata, error, checking, paused, seeding, complete, downloading
+func (ts *TorrentWithStorage) State() string {
+	switch {
+	case ts.trnt.Info() == nil:
+		return "metadata"
+	case ts.Err() != nil:
+		return "error"
+	case ts.rechecking.Load():
+		return "checking"
+	case ts.paused.Load():
+		return "paused"
+	case ts.trnt.Complete.Bool() && Seed:
+		return "seeding"
+	case ts.trnt.Complete.Bool():
+		return "complete"
+	default:
+		return "downloading"
+	}
+}
+
+func (ts *TorrentWithStorage) measureRates() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	stats := ts.trnt.Stats()
+	downloaded, uploaded := stats.BytesReadData.Int64(), stats.BytesWrittenData.Int64()
+	for {
+		select {
+		case <-ts.trnt.Closed():
+			return
+		case <-ticker.C:
+		}
+		stats = ts.trnt.Stats()
+		ts.downloadRate.Store(stats.BytesReadData.Int64() - downloaded)
+		ts.uploadRate.Store(stats.BytesWrittenData.Int64() - uploaded)
+		downloaded, uploaded = stats.BytesReadData.Int64(), stats.BytesWrittenData.Int64()
+	}
+}
+
+// Applies all reasons to allow or disallow the download and upload
+func (ts *TorrentWithStorage) updateDataFlow() {
+	profile := ActiveProfile.Load()
+	paused := ts.paused.Load() || ts.Err() != nil
+	if paused || profile.NoDownload() {
+		ts.trnt.DisallowDataDownload()
+	} else {
+		ts.trnt.AllowDataDownload()
+	}
+	if paused || ts.limits.Throttled() || profile.NoUpload() {
+		ts.trnt.DisallowDataUpload()
+	} else {
+		ts.trnt.AllowDataUpload()
+	}
+}
+
+func updateAllDataFlow() {
+	TSmu.Lock()
+	defer TSmu.Unlock()
+	for _, ts := range TorrentStorages {
+		ts.updateDataFlow()
+	}
+}
+
+// Content of stats.txt
+func writeStatus(w io.Writer) {
+	limitsMu.Lock()
+	limits := GlobalLimits
+	limitsMu.Unlock()
+	profile := ActiveProfile.Load()
+	if profile != nil {
+		limits = profile.Apply(limits)
+	}
+	fmt.Fprintf(w, "Schedule profile: %s\n", profile)
+	fmt.Fprintf(w, "Global limits: %s\n", limits)
+	if Cache != nil {
+		used, total := Cache.Usage()
+		fmt.Fprintf(w, "Cache: %s of %s\n", bytesize.New(float64(used)), bytesize.New(float64(total)))
+	}
+	TSmu.Lock()
+	for path, ts := range TorrentStorages {
+		if ts.paused.Load() {
+			fmt.Fprintf(w, "Paused: %s\n", path)
+		}
+		if err := ts.Err(); err != nil {
+			fmt.Fprintf(w, "Error: %s: %s\n", path, err)
+		}
+		if ts.rechecking.Load() {
+			fmt.Fprintf(w, "Rechecking: %s: %d/%d pieces\n", path, ts.checked.Load(), ts.trnt.NumPieces())
+		}
+	}
+	TSmu.Unlock()
+	if profile.NoDownload() {
+		fmt.Fprintln(w, "Download is paused by schedule")
+	}
+	if profile.NoUpload() {
+		fmt.Fprintln(w, "Upload is paused by schedule")
+	}
+	TorrentClient.WriteStatus(w)
 }
 
 var (
 	PieceCompletion storage.PieceCompletion
 	// TODO Use sync map
-	TorrentStorages map[string]TorrentWithStorage
-	TSmu            sync.Mutex
+	TorrentStorages map[string]*TorrentWithStorage
+	// Paths with storage being opened, not yet in TorrentStorages
+	addingTorrents = make(map[string]bool)
+	// Dirs of new torrent files, not yet added. Their add hook is called once they are
+	newTorrents = make(map[string]bool)
+	TSmu        sync.Mutex
 )
 
 type LoggerProxy struct {
 }
 
 func (l LoggerProxy) Handle(r torrent_log.Record) {
-	log.Info().
-		Str("Level", r.Level.LogString()).
+	var event *zerolog.Event
+	switch r.Level {
+	case torrent_log.Info:
+		event = torrentLog.Info()
+	case torrent_log.Warning:
+		event = torrentLog.Warn()
+	case torrent_log.Error, torrent_log.Critical:
+		event = torrentLog.Error()
+	default:
+		// Messages without level are mostly debug output
+		event = torrentLog.Debug()
+	}
+	event.
 		Str("Msg", r.Msg.String()).
 		Strs("Names", r.Names).
 		Msg("Torrent")
 }
 
 func InitTorrentClient() *torrent.Client {
-	TorrentStorages = make(map[string]TorrentWithStorage)
+	TorrentStorages = make(map[string]*TorrentWithStorage)
 	config := torrent.NewDefaultClientConfig()
 	//config.Logger = torrent_log.Default.WithFilterLevel(torrent_log.Info)
-	config.Seed = true
-	config.ListenPort = 4065
-	config.Logger.Handlers = append(config.Logger.Handlers, LoggerProxy{})
+	config.Seed = Seed
+	config.ListenPort = ListenPort
+	config.NoDHT = !EnableDHT
+	config.DisablePEX = !EnablePEX
+	config.DisableUTP = !EnableUTP
+	config.DisableTCP = !EnableTCP
+	config.DisableIPv4 = !EnableIPv4
+	config.DisableIPv6 = !EnableIPv6
+	config.EstablishedConnsPerTorrent = MaxConns
+	config.Logger = config.Logger.WithFilterLevel(torrentLogFilter())
+	config.Logger.Handlers = []torrent_log.Handler{LoggerProxy{}}
+	config.UploadRateLimiter = UploadLimiter
+	config.DownloadRateLimiter = DownloadLimiter
+	loadGlobalLimits()
+
+	switch Encryption {
+	case "prefer":
+		config.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: true}
+	case "require":
+		config.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{Preferred: true, RequirePreferred: true}
+	case "disable":
+		config.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{}
+	default:
+		log.Fatal().Str("Encryption", Encryption).Msg("Unknown encryption policy, expected prefer, require or disable")
+	}
 
-	// config.HeaderObfuscationPolicy.RequirePreferred = *encrypt
+	if PeerIDPrefix != "" {
+		if len(PeerIDPrefix) > 20 {
+			log.Fatal().Str("Prefix", PeerIDPrefix).Msg("Peer ID prefix must be no longer than 20 bytes")
+		}
+		config.Bep20 = PeerIDPrefix
+	}
+
+	if config.DisableTCP && config.DisableUTP {
+		log.Fatal().Msg("Both TCP and uTP are disabled")
+	}
+	if config.DisableIPv4 && config.DisableIPv6 {
+		log.Fatal().Msg("Both IPv4 and IPv6 are disabled")
+	}
 
 	if ensureDirExists(MetaDataDir) {
 		log.Info().Str("Path", MetaDataDir).Msg("New dir for for storing torrents metadata")
@@ -59,33 +230,113 @@ func InitTorrentClient() *torrent.Client {
 		log.Fatal().Err(err).Msg("Can't open metadata")
 	}
 
-	log.Info().Int("port", config.ListenPort).Msg("Starting torrent client")
+	log.Info().
+		Int("port", config.ListenPort).
+		Bool("seed", config.Seed).
+		Bool("DHT", !config.NoDHT).
+		Str("encryption", Encryption).
+		Msg("Starting torrent client")
 	result, err := torrent.NewClient(config)
 	if err != nil {
-		log.Fatal()
+		log.Fatal().Err(err).Msg("Can't start torrent client")
 	}
 	return result
 }
 
 func AddTorrentSpec(spec *torrent.TorrentSpec, path string) *torrent.Torrent {
-	spec.Storage = NewMMapWithCompletion(path, PieceCompletion)
+	ts := addTorrent(spec, path)
+	if ts == nil {
+		return nil
+	}
+	trnt := ts.trnt
+	TSmu.Lock()
+	new := newTorrents[path]
+	delete(newTorrents, path)
+	TSmu.Unlock()
+	if new {
+		log.Info().Str("infoHASH", fmt.Sprint(trnt.InfoHash())).Msg("Trying to get torrent MetaInfo")
+	}
+	select {
+	case <-trnt.GotInfo():
+	case <-trnt.Closed():
+		return nil
+	}
+	ts.gotInfo(new)
+	return trnt
+}
+
+// Adds torrent with storage in `path` without waiting for info. Returns nil on error or
+// if torrent is already added
+func addTorrent(spec *torrent.TorrentSpec, path string) *TorrentWithStorage {
+	TSmu.Lock()
+	_, in := TorrentStorages[path]
+	if in || addingTorrents[path] {
+		TSmu.Unlock()
+		// Found twice by watcher and dir scan
+		return nil
+	}
+	addingTorrents[path] = true
+	TSmu.Unlock()
+	defer func() {
+		TSmu.Lock()
+		delete(addingTorrents, path)
+		TSmu.Unlock()
+	}()
+	limits := NewTorrentLimits()
+	kind := storageType(path)
+	impl, err := newStorage(path, kind)
+	if err != nil {
+		log.Error().Str("Path", path).Str("Storage", kind).Err(err).Msg("Can't open storage")
+		return nil
+	}
+	if err := checkStorageSpace(impl, spec, path); err != nil {
+		log.Error().Str("Path", path).Err(err).Msg("Can't add torrentSpec")
+		writeErrorFile(path, err)
+		if errors.Is(err, ErrNoSpace) {
+			go retryAddTorrent(path)
+		}
+		return nil
+	}
+	spec.Storage = NewErrorsStorage(NewLimitedStorage(impl, limits.download), path)
 	trnt, _, err := TorrentClient.AddTorrentSpec(spec)
 	if err != nil {
 		log.Error().Str("Path", path).Err(err).Msg("Can't add torrentSpec")
+		writeErrorFile(path, err)
 		return nil
 	}
-	TSmu.Lock()
-	TorrentStorages[path] = TorrentWithStorage{
-		trnt:    trnt,
-		storage: &spec.Storage,
+	os.Remove(path + "/" + ErrorFile)
+	ts := &TorrentWithStorage{
+		path:     path,
+		trnt:     trnt,
+		storage:  &spec.Storage,
+		limits:   limits,
+		kind:     kind,
+		onDemand: OnDemand || onDemandStorages[kind],
 	}
+	_, err = os.Stat(path + "/" + PausedFile)
+	ts.paused.Store(err == nil)
+	TSmu.Lock()
+	TorrentStorages[path] = ts
 	TSmu.Unlock()
+	loadTorrentLimits(path)
+	ts.updateDataFlow()
+	if ts.paused.Load() {
+		log.Info().Str("Path", path).Msg("Torrent is paused")
+	}
+	go limits.watchUpload(trnt, ts.updateDataFlow)
+	trnt.SetOnWriteChunkError(ts.setError)
+	go ts.measureRates()
+	go ts.watchPieces()
+	publishEvent(EventAdded, ts, nil)
+	return ts
+}
 
-	new := trnt.BytesCompleted() == 0
-	if new {
-		log.Info().Str("infoHASH", fmt.Sprint(trnt.InfoHash())).Msg("Trying to get torrent MetaInfo")
+// Called once torrent has info. Torrent added from magnet gets its `this.torrent`
+func (ts *TorrentWithStorage) gotInfo(new bool) {
+	path, trnt := ts.path, ts.trnt
+	if _, err := os.Stat(path + "/" + MagnetFile); err == nil {
+		saveTorrentFile(path, trnt)
 	}
-	<-trnt.GotInfo()
 
 	if new {
 		size := bytesize.New(float64(trnt.Length()))
@@ -98,11 +349,21 @@ func AddTorrentSpec(spec *torrent.TorrentSpec, path string) *torrent.Torrent {
 			Msg("New torrent:")
 	}
 
-	trnt.DownloadAll()
+	publishEvent(EventMetadata, ts, map[string]any{"name": trnt.Name(), "size": trnt.Length()})
+	if new {
+		runHook("add", ts, nil)
+	}
+	applyFilePriorities(path, ts)
+	if Cache != nil {
+		// Pieces found on disk when storage was opened
+		Cache.trim()
+	}
+	if _, err := os.Stat(path + "/" + RecheckFile); err == nil {
+		go ts.recheck()
+	}
 
 	prefix, _ := strings.CutPrefix(path, TorrentsDir)
-	NewWebDavHandler(trnt, prefix)
-	return trnt
+	NewWebDavHandler(trnt, prefix, streamOnlyStorages[ts.kind])
 }
 
 func AddTorrentFile(path string) {
@@ -117,7 +378,8 @@ func AddTorrentFile(path string) {
 	AddTorrentSpec(ts, filepath.Dir(path))
 }
 
-func handleNewTorrentFile(path string) {
+// Moves torrent file into new dir named after torrent. Returns the dir
+func handleNewTorrentFile(path string) (string, error) {
 	mi, err := metainfo.LoadFromFile(path)
 	if err != nil {
 		// File can be uploaded partially. Wait
@@ -125,62 +387,98 @@ func handleNewTorrentFile(path string) {
 		mi, err = metainfo.LoadFromFile(path)
 		if err != nil {
 			log.Error().Str("Path", path).Err(err).Msg("Can't read torrent file")
-			return
+			return "", err
 		}
 	}
 	info, err := mi.UnmarshalInfo()
 	if err != nil {
 		log.Error().Str("Path", path).Err(err).Msg("Can't parse torrent file")
-		return
+		return "", err
 	}
 	name, err := storage.ToSafeFilePath(info.Name)
 	if err != nil {
 		log.Error().Str("Path", path).Str("Name", info.Name).Err(err).Msg("Can't chose correct name for torrent")
-		return
+		return "", err
 	}
 	dir := filepath.Dir(path) + "/" + name
+	adopt, err := hasTorrentData(dir, &info)
+	if err != nil {
+		log.Error().Str("Path", dir).Err(err).Msg("Can't use existing data")
+		return "", err
+	}
+	// Before it's moved, watcher can add it right away
+	setNewTorrent(dir, true)
+	if adopt {
+		// Dir is already watched, no event for it
+		stat, _ := os.Stat(dir)
+		existed := stat.IsDir()
+		err = adoptTorrentData(path, dir, &info)
+		if err != nil {
+			setNewTorrent(dir, false)
+			log.Error().Str("Path", dir).Err(err).Msg("Can't use existing data")
+			return "", err
+		}
+		log.Info().Str("File", path).Str("Name", name).Msg("Found new torrent for existing data")
+		if existed {
+			recursiveScanDir(dir)
+		}
+		return dir, nil
+	}
 	err = os.Mkdir(dir, 0o750)
 	if err != nil {
+		setNewTorrent(dir, false)
 		log.Error().Str("Path", dir).Err(err).Msg("Can't create dir")
-		return
+		return "", err
 	}
 	err = os.Rename(path, dir+"/this.torrent")
 	if err != nil {
+		setNewTorrent(dir, false)
 		log.Error().Str("Path", dir).Err(err).Msg("Can't move torrent file")
-		return
+		return "", err
 	}
 	log.Info().Str("File", path).Str("Name", name).Msg("Found new torrent")
+	return dir, nil
 }
 
-func parseMagnetsFile(path string) {
-	buf, err := os.ReadFile(path)
+// Marks torrent dir as holding a new torrent, so add hook is called when it's added
+func setNewTorrent(dir string, isNew bool) {
+	TSmu.Lock()
+	if isNew {
+		newTorrents[dir] = true
+	} else {
+		delete(newTorrents, dir)
+	}
+	TSmu.Unlock()
+}
+
+func writeErrorFile(path string, reason error) {
+	err := os.WriteFile(path+"/"+ErrorFile, []byte(reason.Error()+"\n"), 0o644)
 	if err != nil {
-		time.Sleep(time.Second * 3)
-		buf, err = os.ReadFile(path)
-		if err != nil {
-			log.Error().Err(err).Str("Path", path).Msg("Can't read file")
-			return
-		}
+		log.Error().Str("Path", path).Err(err).Msg("Can't write error file")
 	}
-	log.Info().Str("Path", path).Msg("Parsing Magnets file")
-	for _, line := range strings.Split(string(buf), "\n") {
-		trnt, err := TorrentClient.AddMagnet(line)
-		if err != nil {
-			log.Warn().Err(err).Str("URI", line).Str("File", path).Msg("Can't add Magnet")
-			continue
-		}
-		<-trnt.GotInfo()
-		filename := filepath.Dir(path) + "/" + fmt.Sprint(time.Now().UnixNano()) + "-from-Magnet.torrent"
-		file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, os.ModePerm)
-		err = trnt.Metainfo().Write(file)
-		if err != nil {
-			log.Warn().Err(err).Str("URI", line).Str("File", path).Msg("Can't create torrent file from Magnet")
-		}
-		trnt.Drop()
-		file.Close()
-		time.Sleep(time.Nanosecond * 2)
+}
+
+// Called when `paused` file is created or removed in torrent dir
+func updatePaused(path string) {
+	TSmu.Lock()
+	ts, in := TorrentStorages[path]
+	TSmu.Unlock()
+	if !in {
+		return
+	}
+	_, err := os.Stat(path + "/" + PausedFile)
+	paused := err == nil
+	if ts.paused.Swap(paused) == paused {
+		return
+	}
+	ts.updateDataFlow()
+	if paused {
+		log.Info().Str("Path", path).Msg("Torrent paused")
+		publishEvent(EventPaused, ts, nil)
+	} else {
+		log.Info().Str("Path", path).Msg("Torrent resumed")
+		publishEvent(EventResumed, ts, nil)
 	}
-	os.Remove(path)
 }
 
 func dropTorrent(path string) {
@@ -189,7 +487,10 @@ func dropTorrent(path string) {
 	if in {
 		ts.trnt.Drop()
 		delete(TorrentStorages, path)
+		prefix, _ := strings.CutPrefix(path, TorrentsDir)
+		RemoveWebDavHandler(ts.trnt, prefix)
 		log.Info().Str("Path", path).Msg("Torrent dropped")
+		publishEvent(EventDropped, ts, nil)
 	}
 	TSmu.Unlock()
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var UsersFile string
+
+type User struct {
+	Name     string
+	hash     string // bcrypt or argon2id
+	Home     string // Dir inside torrents dir, as in WebDav path. `/` for all
+	Write    bool   // Can change files
+	Torrents bool   // Can add, drop and manage torrents
+}
+
+// All rights, when auth is off and for control socket
+var adminUser = &User{Home: "/", Write: true, Torrents: true}
+
+type userList struct {
+	users map[string]*User
+	// Name -> sha256 of password which matched the hash. Checking bcrypt on every
+	// WebDav request is too slow
+	verified   map[string][sha256.Size]byte
+	verifiedMu sync.Mutex
+}
+
+var Users atomic.Pointer[userList]
+
+// Torrents are controlled by these files, users without Torrents right can't change them
+var torrentControlFiles = map[string]bool{
+	"this.torrent": true,
+	MagnetFile:     true,
+	"magnet.txt":   true,
+	PausedFile:     true,
+	RecheckFile:    true,
+	FilesFile:      true,
+	LimitsFile:     true,
+	StorageFile:    true,
+}
+
+// Methods which don't change files
+var readMethods = map[string]bool{
+	"GET":      true,
+	"HEAD":     true,
+	"OPTIONS":  true,
+	"PROPFIND": true,
+}
+
+type userKey struct{}
+
+func (u *User) isRoot() bool {
+	return u.Home == "/"
+}
+
+// `rel` is a path inside torrents dir, like `/Movies/Film`
+func (u *User) allowed(rel string) bool {
+	return u.isRoot() || rel == u.Home || strings.HasPrefix(rel, u.Home+"/")
+}
+
+// `dir` is a path on disk, like torrents/Movies/Film
+func (u *User) allowedDir(dir string) bool {
+	rel, err := filepath.Rel(TorrentsDir, dir)
+	if err != nil {
+		return false
+	}
+	return u.allowed(path.Clean("/" + filepath.ToSlash(rel)))
+}
+
+// File format, one user per line:
+//
+//	# name:password hash:home:rights
+//	admin:$2y$10$...:/:rw,torrents
+//	guest:$argon2id$v=19$m=65536,t=3,p=4$...:/Movies:ro
+//
+// Hash is bcrypt or argon2id. Home is a dir inside torrents dir, `/` by default. Rights are
+// `ro` (default) or `rw`, and `torrents` to add, drop and manage torrents
+func readUsersFile(name string) (map[string]*User, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 4 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expected name:hash:home:rights", n)
+		}
+		user := &User{Name: fields[0], hash: fields[1], Home: "/"}
+		if !strings.HasPrefix(user.hash, "$2") && !strings.HasPrefix(user.hash, "$argon2id$") {
+			return nil, fmt.Errorf("line %d: password hash must be bcrypt or argon2id", n)
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			user.Home = path.Clean("/" + fields[2])
+		}
+		if len(fields) > 3 {
+			for _, right := range strings.Split(fields[3], ",") {
+				switch strings.TrimSpace(right) {
+				case "ro", "":
+				case "rw":
+					user.Write = true
+				case "torrents":
+					user.Torrents = true
+				default:
+					return nil, fmt.Errorf("line %d: unknown right %q, expected ro, rw or torrents", n, right)
+				}
+			}
+		}
+		if _, ok := users[user.Name]; ok {
+			return nil, fmt.Errorf("line %d: user %q is already defined", n, user.Name)
+		}
+		users[user.Name] = user
+	}
+	return users, scanner.Err()
+}
+
+// On start and reload. Previous users are kept if file is wrong
+func loadUsers() error {
+	if UsersFile == "" {
+		return nil
+	}
+	users, err := readUsersFile(UsersFile)
+	if err != nil {
+		return err
+	}
+	Users.Store(&userList{users: users, verified: make(map[string][sha256.Size]byte)})
+	log.Info().Str("Path", UsersFile).Int("Count", len(users)).Msg("Users loaded")
+	return nil
+}
+
+func (l *userList) check(name, password string) *User {
+	user, ok := l.users[name]
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(password))
+	l.verifiedMu.Lock()
+	verified, ok := l.verified[name]
+	l.verifiedMu.Unlock()
+	if ok && subtle.ConstantTimeCompare(verified[:], sum[:]) == 1 {
+		return user
+	}
+	if err := checkPassword(user.hash, password); err != nil {
+		return nil
+	}
+	l.verifiedMu.Lock()
+	l.verified[name] = sum
+	l.verifiedMu.Unlock()
+	return user
+}
+
+func checkPassword(hash, password string) error {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errors.New("wrong argon2id hash")
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return fmt.Errorf("wrong argon2id parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return err
+	}
+	actual := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return errors.New("wrong password")
+	}
+	return nil
+}
+
+// Basic Auth. Returns nil if request is rejected, the response is written then
+func authenticate(w http.ResponseWriter, req *http.Request) *User {
+	list := Users.Load()
+	if Username == "" && list == nil {
+		return adminUser
+	}
+	name, password, ok := req.BasicAuth()
+	webdavLog.Debug().
+		Str("IP", req.RemoteAddr).
+		Str("username", name).
+		Bool("ok", ok).
+		Msg("BasicAuth Request")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	if Username != "" && name == Username && subtle.ConstantTimeCompare([]byte(password), []byte(Password)) == 1 {
+		return &User{Name: name, Home: "/", Write: true, Torrents: true}
+	}
+	if list != nil {
+		if user := list.check(name, password); user != nil {
+			return user
+		}
+	}
+	webdavLog.Warn().Str("IP", req.RemoteAddr).Str("username", name).Msg("Wrong username or password")
+	w.WriteHeader(http.StatusUnauthorized)
+	return nil
+}
+
+func withUser(req *http.Request, user *User) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+}
+
+// User of authenticated request. Requests from control socket have all rights
+func requestUser(req *http.Request) *User {
+	if user, ok := req.Context().Value(userKey{}).(*User); ok {
+		return user
+	}
+	return adminUser
+}
+
+// Path inside torrents dir from URL path
+func webDavRel(urlPath, secret string) string {
+	rel, _ := strings.CutPrefix(urlPath, secret)
+	return path.Clean("/" + rel)
+}
+
+// Checks access to regular files and torrent content. Writes response if denied
+func authorizeWebDav(w http.ResponseWriter, req *http.Request, user *User, secret string) bool {
+	rel := webDavRel(req.URL.Path, secret)
+	if !user.allowed(rel) {
+		if (req.Method == "GET" || req.Method == "HEAD") && rel == "/" {
+			http.Redirect(w, req, path.Join(secret, user.Home)+"/", http.StatusFound)
+			return false
+		}
+		http.Error(w, "Outside of home dir", http.StatusForbidden)
+		return false
+	}
+	if readMethods[req.Method] {
+		return true
+	}
+	if !user.Write {
+		http.Error(w, "Read-only access", http.StatusForbidden)
+		return false
+	}
+
+	targets := []string{rel}
+	if dest := req.Header.Get("Destination"); dest != "" {
+		u, err := url.Parse(dest)
+		if err != nil {
+			http.Error(w, "Wrong Destination", http.StatusBadRequest)
+			return false
+		}
+		destRel := webDavRel(u.Path, secret)
+		if !user.allowed(destRel) {
+			http.Error(w, "Destination is outside of home dir", http.StatusForbidden)
+			return false
+		}
+		targets = append(targets, destRel)
+	}
+	if !user.Torrents {
+		for _, target := range targets {
+			if controlsTorrents(target) {
+				http.Error(w, "No rights to manage torrents", http.StatusForbidden)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Changing this path adds, drops or controls torrents
+func controlsTorrents(rel string) bool {
+	name := path.Base(rel)
+	if torrentControlFiles[name] || strings.HasSuffix(name, ".torrent") {
+		return true
+	}
+	dir := filepath.Join(TorrentsDir, filepath.FromSlash(rel))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return false
+	}
+	found := false
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && isTorrentDir(p) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
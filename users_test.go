@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	adminHash = "$2a$10$qtoy45PF85gOE1qK2adQiuTwDdj2inCjYMJ31JHYaULiwiUT7F7BK"                                      // adminpw
+	guestHash = "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHRzYWx0c2FsdA$2+cKSLxImjaLnx0J9m5+Kt0dAloAIPuoEuR8ZdPIF1A" // guestpw
+)
+
+func TestReadUsersFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    map[string]*User
+		wantErr bool
+	}{
+		{
+			name: "users",
+			file: "# name:password hash:home:rights\n\n" +
+				"admin:" + adminHash + ":/:rw,torrents\n" +
+				"  guest:" + guestHash + ":Movies/:ro  \n" +
+				"viewer:" + adminHash + "\n" +
+				"editor:" + adminHash + "::rw\n",
+			want: map[string]*User{
+				"admin":  {Name: "admin", hash: adminHash, Home: "/", Write: true, Torrents: true},
+				"guest":  {Name: "guest", hash: guestHash, Home: "/Movies"},
+				"viewer": {Name: "viewer", hash: adminHash, Home: "/"},
+				"editor": {Name: "editor", hash: adminHash, Home: "/", Write: true},
+			},
+		},
+		{
+			name: "empty",
+			file: "# nobody\n",
+			want: map[string]*User{},
+		},
+		{
+			name:    "unknown right",
+			file:    "admin:" + adminHash + ":/:rw,all\n",
+			wantErr: true,
+		},
+		{
+			name:    "plain password",
+			file:    "admin:adminpw\n",
+			wantErr: true,
+		},
+		{
+			name:    "no hash",
+			file:    "admin\n",
+			wantErr: true,
+		},
+		{
+			name:    "no name",
+			file:    ":" + adminHash + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "too many fields",
+			file:    "admin:" + adminHash + ":/:rw:torrents\n",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate",
+			file:    "admin:" + adminHash + "\nadmin:" + guestHash + "\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "users.txt")
+			if err := os.WriteFile(name, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readUsersFile(name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		hash     string
+		password string
+		ok       bool
+	}{
+		{adminHash, "adminpw", true},
+		{adminHash, "guestpw", false},
+		{adminHash, "", false},
+		{guestHash, "guestpw", true},
+		{guestHash, "adminpw", false},
+		{guestHash, "", false},
+		{"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA", "guestpw", false},
+		{"$argon2id$v=16$m=65536,t=3,p=4$c2FsdHNhbHRzYWx0c2FsdA$2+cKSLxImjaLnx0J9m5+Kt0dAloAIPuoEuR8ZdPIF1A", "guestpw", false},
+		{"$argon2id$v=19$m=65536$c2FsdHNhbHRzYWx0c2FsdA$2+cKSLxImjaLnx0J9m5+Kt0dAloAIPuoEuR8ZdPIF1A", "guestpw", false},
+		{"$argon2id$v=19$m=65536,t=3,p=4$!!!$2+cKSLxImjaLnx0J9m5+Kt0dAloAIPuoEuR8ZdPIF1A", "guestpw", false},
+		{"$2a$10$broken", "adminpw", false},
+	}
+	for _, tt := range tests {
+		err := checkPassword(tt.hash, tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkPassword(%q, %q) = %v, want ok %v", tt.hash, tt.password, err, tt.ok)
+		}
+	}
+}
+
+func TestUserAllowed(t *testing.T) {
+	user := &User{Home: "/Movies"}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"/Movies", true},
+		{"/Movies/Film", true},
+		{"/MoviesOld", false},
+		{"/", false},
+		{"/Other/Movies", false},
+	}
+	for _, tt := range tests {
+		if got := user.allowed(tt.rel); got != tt.want {
+			t.Errorf("allowed(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+	if !adminUser.allowed("/Other") {
+		t.Error("admin is not allowed everywhere")
+	}
+}
+
+// Torrents dir with a torrent dir and a plain dir in `/Movies`, and other dir `/Other`
+func setTestTorrentsDir(t *testing.T) {
+	old := TorrentsDir
+	TorrentsDir = t.TempDir()
+	t.Cleanup(func() { TorrentsDir = old })
+	for _, name := range []string{"Movies/Film/this.torrent", "Movies/notes/a.txt", "Other/b.txt"} {
+		file := filepath.Join(TorrentsDir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuthorizeWebDav(t *testing.T) {
+	setTestTorrentsDir(t)
+	ro := &User{Name: "ro", Home: "/Movies"}
+	rw := &User{Name: "rw", Home: "/Movies", Write: true}
+	manager := &User{Name: "manager", Home: "/Movies", Write: true, Torrents: true}
+	tests := []struct {
+		user        *User
+		method      string
+		path        string
+		destination string
+		code        int // 0 if allowed
+		location    string
+	}{
+		{ro, "GET", "/s/Movies/Film/a.mkv", "", 0, ""},
+		{ro, "PROPFIND", "/s/Movies/", "", 0, ""},
+		{ro, "PUT", "/s/Movies/notes/b.txt", "", http.StatusForbidden, ""},
+		{ro, "DELETE", "/s/Movies/notes/a.txt", "", http.StatusForbidden, ""},
+		{ro, "MKCOL", "/s/Movies/new", "", http.StatusForbidden, ""},
+		{ro, "GET", "/s/", "", http.StatusFound, "/s/Movies/"},
+		{ro, "GET", "/s", "", http.StatusFound, "/s/Movies/"},
+		{ro, "PROPFIND", "/s/", "", http.StatusForbidden, ""},
+		{ro, "GET", "/s/Other/b.txt", "", http.StatusForbidden, ""},
+		{ro, "GET", "/s/Movies/../Other/b.txt", "", http.StatusForbidden, ""},
+		{ro, "GET", "/s/MoviesOld/b.txt", "", http.StatusForbidden, ""},
+
+		{rw, "PUT", "/s/Movies/notes/b.txt", "", 0, ""},
+		{rw, "DELETE", "/s/Movies/notes/a.txt", "", 0, ""},
+		{rw, "MOVE", "/s/Movies/notes", "/s/Movies/notes2", 0, ""},
+		{rw, "COPY", "/s/Movies/notes/a.txt", "http://host/s/Movies/notes/c.txt", 0, ""},
+		{rw, "DELETE", "/s/Movies/Film", "", http.StatusForbidden, ""},
+		{rw, "DELETE", "/s/Movies", "", http.StatusForbidden, ""},
+		{rw, "MOVE", "/s/Movies/Film", "/s/Movies/notes/Film", http.StatusForbidden, ""},
+		{rw, "COPY", "/s/Movies/Film", "/s/Movies/Film2", http.StatusForbidden, ""},
+		{rw, "MOVE", "/s/Movies/notes/a.txt", "/s/Movies/notes/a.torrent", http.StatusForbidden, ""},
+		{rw, "COPY", "/s/Movies/notes/a.txt", "/s/Movies/new/this.torrent", http.StatusForbidden, ""},
+		{rw, "PUT", "/s/Movies/notes/x.torrent", "", http.StatusForbidden, ""},
+		{rw, "PUT", "/s/Movies/notes/magnet.txt", "", http.StatusForbidden, ""},
+		{rw, "PUT", "/s/Movies/Film/paused", "", http.StatusForbidden, ""},
+		{rw, "PUT", "/s/Movies/Film/files.txt", "", http.StatusForbidden, ""},
+		{rw, "PUT", "/s/Movies/Film/storage.txt", "", http.StatusForbidden, ""},
+		{rw, "PUT", "/s/Movies/notes/storage.txt", "", http.StatusForbidden, ""},
+		{rw, "MOVE", "/s/Movies/notes/a.txt", "/s/Other/a.txt", http.StatusForbidden, ""},
+		{rw, "MOVE", "/s/Movies/notes/a.txt", "/s/Movies/../Other/a.txt", http.StatusForbidden, ""},
+		{rw, "COPY", "/s/Movies/notes/a.txt", "%zz", http.StatusBadRequest, ""},
+
+		{manager, "DELETE", "/s/Movies/Film", "", 0, ""},
+		{manager, "MOVE", "/s/Movies/notes/a.txt", "/s/Movies/notes/a.torrent", 0, ""},
+		{manager, "PUT", "/s/Movies/Film/storage.txt", "", 0, ""},
+		{manager, "DELETE", "/s/Other/b.txt", "", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://host/", nil)
+		req.URL.Path = tt.path
+		if tt.destination != "" {
+			req.Header.Set("Destination", tt.destination)
+		}
+		w := httptest.NewRecorder()
+		allowed := authorizeWebDav(w, req, tt.user, "/s")
+		code := 0
+		if !allowed {
+			code = w.Code
+		}
+		if code != tt.code {
+			t.Errorf("%s %s %s -> %q: code %d, want %d", tt.user.Name, tt.method, tt.path, tt.destination, code, tt.code)
+		}
+		if location := w.Header().Get("Location"); location != tt.location {
+			t.Errorf("%s %s %s: location %q, want %q", tt.user.Name, tt.method, tt.path, location, tt.location)
+		}
+	}
+}
+
+// Torrent client with memory storage, torrents are added into TorrentsDir
+func setTestClient(t *testing.T) {
+	oldClient, oldServer, oldStorages, oldType := TorrentClient, Server, TorrentStorages, StorageType
+	t.Cleanup(func() {
+		TorrentClient, Server, TorrentStorages, StorageType = oldClient, oldServer, oldStorages, oldType
+	})
+	config := torrent.NewDefaultClientConfig()
+	config.ListenPort = 0
+	config.NoDHT = true
+	config.DataDir = t.TempDir()
+	client, err := torrent.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	TorrentClient = client
+	Server = &WebDAVServer{handlers: make(map[string]*handler)}
+	TorrentStorages = make(map[string]*TorrentWithStorage)
+	StorageType = "memory"
+}
+
+func TestAPIAddTorrentDir(t *testing.T) {
+	setTestTorrentsDir(t)
+	setTestClient(t)
+	user := &User{Name: "manager", Home: "/Movies", Write: true, Torrents: true}
+	for i, dir := range []string{"../..", "../Other", "/../../new", "notes/../../.."} {
+		info := metainfo.Info{Name: fmt.Sprintf("file%d.bin", i), Length: 10, PieceLength: 16384, Pieces: make([]byte, 20)}
+		mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+		var body bytes.Buffer
+		if err := mi.Write(&body); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", APIPath+"/torrents?dir="+url.QueryEscape(dir), &body)
+		w := httptest.NewRecorder()
+		serveAPI(w, withUser(req, user), "")
+		var added apiAdded
+		json.NewDecoder(w.Body).Decode(&added)
+		if w.Code != http.StatusCreated || !strings.HasPrefix(added.Path, "/Movies/") {
+			t.Errorf("dir %q: code %d, path %q", dir, w.Code, added.Path)
+		}
+		if _, err := os.Stat(filepath.Join(TorrentsDir, "Movies", filepath.FromSlash(strings.TrimPrefix(added.Path, "/Movies/")), "this.torrent")); err != nil {
+			t.Errorf("dir %q: %v", dir, err)
+		}
+	}
+	if entries, _ := os.ReadDir(TorrentsDir); len(entries) != 2 {
+		t.Errorf("torrents dir has %d entries, want Movies and Other", len(entries))
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"strings"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/rs/zerolog/log"
 )
 
 var Watcher *fsnotify.Watcher
@@ -15,7 +14,7 @@ func initWatcher() {
 	var err error
 	Watcher, err = fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal().Err(err).Msg("fsnotify.NewWatcher:")
+		watcherLog.Fatal().Err(err).Msg("fsnotify.NewWatcher:")
 	}
 
 	// Start listening for events
@@ -26,10 +25,38 @@ func initWatcher() {
 				if !ok {
 					return
 				}
+				if handleCertEvent(event) {
+					continue
+				}
 				if event.Has(fsnotify.Write) {
 					if strings.HasSuffix(event.Name, "/magnet.txt") {
-						parseMagnetsFile(event.Name)
+						go parseMagnetsFile(event.Name)
+					}
+				}
+
+				if strings.HasSuffix(event.Name, "/"+LimitsFile) {
+					path := filepath.Dir(event.Name)
+					if path == TorrentsDir {
+						loadGlobalLimits()
+					} else {
+						loadTorrentLimits(path)
 					}
+					continue
+				}
+
+				if strings.HasSuffix(event.Name, "/"+PausedFile) && isTorrentDir(filepath.Dir(event.Name)) {
+					updatePaused(filepath.Dir(event.Name))
+					continue
+				}
+
+				if strings.HasSuffix(event.Name, "/"+RecheckFile) && isTorrentDir(filepath.Dir(event.Name)) {
+					recheckTorrent(filepath.Dir(event.Name))
+					continue
+				}
+
+				if strings.HasSuffix(event.Name, "/"+FilesFile) && isTorrentDir(filepath.Dir(event.Name)) {
+					reloadFilePriorities(filepath.Dir(event.Name))
+					continue
 				}
 
 				if strings.HasSuffix(event.Name, "/this.torrent") {
@@ -40,16 +67,28 @@ func initWatcher() {
 					}
 				}
 
+				// Magnet removed before metadata received
+				if strings.HasSuffix(event.Name, "/"+MagnetFile) && event.Has(fsnotify.Remove) {
+					path := filepath.Dir(event.Name)
+					if _, err := os.Stat(path + "/this.torrent"); err != nil {
+						dropTorrent(path)
+					}
+					continue
+				}
+
 				// Skip all other events in torrent dir
-				_, err := os.Stat(filepath.Dir(event.Name) + "/this.torrent")
-				if err == nil {
+				if isTorrentDir(filepath.Dir(event.Name)) {
 					continue
 				}
 
 				if event.Has(fsnotify.Create) {
 					stat, err := os.Stat(event.Name)
+					if os.IsNotExist(err) {
+						// Already moved, e.g. data adopted by new torrent
+						continue
+					}
 					if err != nil {
-						log.Error().Err(err).Str("Name", event.Name).Msg("Watcher Error")
+						watcherLog.Error().Err(err).Str("Name", event.Name).Msg("Watcher Error")
 						continue
 					}
 					if stat.IsDir() {
@@ -72,40 +111,57 @@ func initWatcher() {
 				if !ok {
 					return
 				}
-				log.Error().Err(err).Msg("Error in watcher:")
+				watcherLog.Error().Err(err).Msg("Error in watcher:")
 			}
 		}
 	}()
 }
 
+// Has `this.torrent` or `this.magnet`
+func isTorrentDir(path string) bool {
+	_, err := os.Stat(path + "/this.torrent")
+	if err != nil {
+		_, err = os.Stat(path + "/" + MagnetFile)
+	}
+	return err == nil
+}
+
 func recursiveScanDir(path string) bool {
 	err := Watcher.Add(path)
 	if err != nil {
-		log.Error().Str("Path", path).Err(err).Msg("Cant add to watcher:")
+		watcherLog.Error().Str("Path", path).Err(err).Msg("Cant add to watcher:")
 	}
 
 	_, err = os.Stat(path + "/this.torrent")
 	if err == nil {
-		log.Info().Str("Path", path).Msg("Found torrent")
+		watcherLog.Info().Str("Path", path).Msg("Found torrent")
 		AddTorrentFile(path + "/this.torrent")
 		return false
 	}
 
-	log.Info().Str("Path", path).Msg("Watching dir")
+	_, err = os.Stat(path + "/" + MagnetFile)
+	if err == nil {
+		watcherLog.Info().Str("Path", path).Msg("Found magnet")
+		go addMagnetDir(path)
+		return false
+	}
+
+	watcherLog.Info().Str("Path", path).Msg("Watching dir")
 
 	_, err = os.Stat(path + "/magnet.txt")
 	if err == nil {
-		parseMagnetsFile(path + "/magnet.txt")
+		go parseMagnetsFile(path + "/magnet.txt")
 	}
 
 	files, err := os.ReadDir(path)
 	if err != nil {
-		log.Fatal().Str("Path", path).Err(err).Msg("Cant read dir")
+		watcherLog.Fatal().Str("Path", path).Err(err).Msg("Cant read dir")
 		return false
 	}
-	// Searching for new torrents since the server shutdown
+	// Searching for new torrents since the server shutdown. `this.torrent` is being moved
+	// here right now, the dir is a new torrent dir
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".torrent") {
+		if strings.HasSuffix(file.Name(), ".torrent") && file.Name() != "this.torrent" {
 			handleNewTorrentFile(path + "/" + file.Name())
 		}
 	}
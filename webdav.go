@@ -1,15 +1,16 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Jipok/webdavWithPATCH"
 	"github.com/anacrolix/torrent"
-	"github.com/rs/zerolog/log"
 	"golang.org/x/net/webdav"
 )
 
@@ -23,6 +24,8 @@ type handler struct {
 
 type WebDAVServer struct {
 	addr     string // Address to listen on, e.g. "0.0.0.0:8080"
+	srv      *http.Server
+	redirect *http.Server // HTTP to HTTPS
 	smux     *http.ServeMux
 	handlers map[string]*handler
 	mu       sync.RWMutex
@@ -48,40 +51,40 @@ func NewWebDAVServer(addr string, secret string) *WebDAVServer {
 			return
 		}
 
-		// Basic Auth
-		if Username != "" {
-			req_username, req_password, ok := req.BasicAuth()
-			log.Debug().
-				Str("IP", req.RemoteAddr).
-				Str("username", req_username).
-				Str("password", req_password).
-				Bool("ok", ok).
-				Msg("BasicAuth Request")
-			if !ok {
-				w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			if req_username != Username || req_password != Password {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
+		user := authenticate(w, req)
+		if user == nil {
+			return
 		}
+		req = withUser(req, user)
 
 		method := req.Method
-		log.Debug().Str("URL", req.URL.Path).Str("Method", method).Msg("Web Request")
+		webdavLog.Debug().Str("URL", req.URL.Path).Str("Method", method).Msg("Web Request")
+
+		start := time.Now()
+		kind := "main"
+		defer func() { observeRequest(method, kind, start) }()
+
+		if strings.HasPrefix(req.URL.Path, filepath.Join(secret, APIPath)+"/") {
+			kind = "api"
+			serveAPI(w, req, secret)
+			return
+		}
 
 		// Serve fake file
-		if (method == "GET" || method == "HEAD") && req.URL.Path == filepath.Join(secret, "stats.txt") {
-			TorrentClient.WriteStatus(w)
+		if (method == "GET" || method == "HEAD") && req.URL.Path == filepath.Join(secret, "stats.txt") && user.isRoot() {
+			kind = "stats"
+			writeStatus(w)
 			return
 		}
 
-		// Try find torrent
+		if !authorizeWebDav(w, req, user, secret) {
+			return
+		}
+
+		// Try find torrent. Not locked while streaming, so torrents can be added and dropped
+		var found *handler
 		WDSrv.mu.RLock()
 		for prefix, handler := range WDSrv.handlers {
-			println(req.URL.Path)
-			println(prefix)
 			if !strings.HasPrefix(req.URL.Path, prefix) {
 				continue
 			}
@@ -92,20 +95,24 @@ func NewWebDAVServer(addr string, secret string) *WebDAVServer {
 			// a regular file system. The only differences will be when reading unfinished files.
 			filename, _ := strings.CutPrefix(req.URL.Path, prefix)
 			if !handler.tfs.IsFileCompleted(filename) {
-				log.Debug().Str("url", req.URL.Path).Msg("Streaming torrent content")
-				handler.ServeHTTP(w, req)
-				WDSrv.mu.RUnlock()
-				return
+				found = handler
+				break
 			}
-			log.Debug().Str("Prefix", prefix).Msg("Access to completed torrent content")
+			webdavLog.Debug().Str("Prefix", prefix).Msg("Access to completed torrent content")
 		}
 		WDSrv.mu.RUnlock()
+		if found != nil {
+			webdavLog.Debug().Str("url", req.URL.Path).Msg("Streaming torrent content")
+			kind = "torrent"
+			found.ServeHTTP(w, req)
+			return
+		}
 
 		// Work as a WebDav or Web server for a regular file system
 
 		if method == "GET" && strings.HasSuffix(req.URL.Path, "/") {
 			if _, err := w.Write(WebdavjsHTML); err != nil {
-				log.Error().Err(err).Msg("Failed to write index.html")
+				webdavLog.Error().Err(err).Msg("Failed to write index.html")
 			}
 			return
 		}
@@ -118,22 +125,55 @@ func NewWebDAVServer(addr string, secret string) *WebDAVServer {
 		mainHandler.ServeHTTP(w, req)
 	})
 
+	initMetrics(WDSrv.smux)
+	WDSrv.srv = &http.Server{Addr: addr, Handler: WDSrv.smux}
+	if tlsEnabled() && TLSRedirect != "" {
+		WDSrv.redirect = newRedirect(TLSRedirect)
+	}
+
 	return &WDSrv
 }
 
 func (s *WebDAVServer) Run() {
-	log.Info().Str("addr", "http://"+s.addr+WebDavPath).Msg("WebDAV server started")
-	if err := http.ListenAndServe(s.addr, s.smux); err != nil {
+	if !tlsEnabled() {
+		webdavLog.Info().Str("addr", "http://"+s.addr+WebDavPath).Msg("WebDAV server started")
+		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+		return
+	}
+	if s.redirect != nil {
+		go runRedirect(s.redirect)
+	}
+	s.srv.TLSConfig = tlsConfig()
+	webdavLog.Info().Str("addr", "https://"+s.addr+WebDavPath).Msg("WebDAV server started")
+	if err := s.srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
 }
 
+// Closed on shutdown, for endless requests like events stream
+var shuttingDown = make(chan struct{})
+
+// Stops accepting requests and waits for active ones until ctx is done, then breaks them
+func (s *WebDAVServer) Shutdown(ctx context.Context) {
+	close(shuttingDown)
+	if s.redirect != nil {
+		s.redirect.Close()
+	}
+	if err := s.srv.Shutdown(ctx); err != nil {
+		webdavLog.Warn().Err(err).Msg("WebDAV requests interrupted")
+		s.srv.Close()
+	}
+}
+
 /////////////////////////////////////////////////////////////////////////////////
 
-func NewWebDavHandler(trnt *torrent.Torrent, prefix string) {
+func NewWebDavHandler(trnt *torrent.Torrent, prefix string, streamOnly bool) {
 	prefix = filepath.Join(WebDavPath, prefix)
-	log.Debug().Str("Prefix", prefix).Msg("New WebDav Handler")
+	webdavLog.Debug().Str("Prefix", prefix).Msg("New WebDav Handler")
 	tfs := *NewTFS(trnt)
+	tfs.streamOnly = streamOnly
 	handler := &handler{
 		tfs: tfs,
 		handler: &webdavWithPATCH.Handler{
@@ -149,6 +189,16 @@ func NewWebDavHandler(trnt *torrent.Torrent, prefix string) {
 	Server.mu.Unlock()
 }
 
+// Called when torrent is dropped. Handler of a new torrent in the same dir is kept
+func RemoveWebDavHandler(trnt *torrent.Torrent, prefix string) {
+	prefix = filepath.Join(WebDavPath, prefix)
+	Server.mu.Lock()
+	if h, ok := Server.handlers[prefix]; ok && h.tfs.torrent == trnt {
+		delete(Server.handlers, prefix)
+	}
+	Server.mu.Unlock()
+}
+
 func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	allowedMethods := map[string]bool{
 		"GET":      true,
@@ -163,7 +213,7 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/") {
 		if _, err := w.Write(WebdavjsHTML); err != nil {
-			log.Error().Err(err).Msg("Failed to write index.html")
+			webdavLog.Error().Err(err).Msg("Failed to write index.html")
 		}
 		return
 	}